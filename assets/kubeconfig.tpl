@@ -5,7 +5,15 @@ clusters:
     insecure-skip-tls-verify: true
 {{- else if .Certificate }}
     certificate-authority-data: {{ .Certificate }}
+{{- else if .CertificateFile }}
+    certificate-authority: {{ .CertificateFile }}
 {{- end}}
+{{- if .TLSServerName }}
+    tls-server-name: {{ .TLSServerName }}
+{{- end }}
+{{- if .ProxyURL }}
+    proxy-url: {{ .ProxyURL }}
+{{- end }}
     server: {{ .APIServer }}
   name: helm
 contexts:
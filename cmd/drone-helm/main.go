@@ -13,15 +13,15 @@ func main() {
 	cfg, err := env.NewConfig(os.Stdout, os.Stderr)
 
 	if err != nil {
+		// there's no config to redact with yet
 		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
-		return
+		os.Exit(1)
 	}
 
 	// Make the plan
 	plan, err := helm.NewPlan(*cfg)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
-		os.Exit(1)
+		fail(cfg, err)
 	}
 
 	// Execute the plan
@@ -29,8 +29,16 @@ func main() {
 
 	// Expect the plan to go off the rails
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 		// Throw away the plan
-		os.Exit(1)
+		fail(cfg, err)
 	}
+
+	cfg.Flush()
+}
+
+// fail reports an error through the config's redacting writer, so secrets in it stay masked, and exits.
+func fail(cfg *env.Config, err error) {
+	fmt.Fprintf(cfg.Stderr, "%s\n", err.Error())
+	cfg.Flush()
+	os.Exit(1)
 }
@@ -11,13 +11,16 @@ import (
 )
 
 const (
-	DefaultHistoryMax = 10
+	DefaultHistoryMax          = 10
+	DefaultBuildMetadataPrefix = "drone"
+	DefaultPreviewEnvFile      = ".preview.env"
+	DefaultFailureLogLines     = 20
 )
 
 var (
 	justNumbers    = regexp.MustCompile(`^\d+$`)
 	deprecatedVars = []string{"PURGE", "RECREATE_PODS", "UPGRADE", "CANARY_IMAGE", "CLIENT_ONLY", "STABLE_REPO_URL"}
-	convertVars    = []string{"DELETE_V2_RELEASES", "RELEASE_VERSIONS_MAX", "TILLER_NS", "TILLER_LABEL"}
+	convertVars    = []string{"DELETE_V2_RELEASES", "RELEASE_VERSIONS_MAX", "TILLER_NS", "TILLER_LABEL", "TILLER_STORAGE", "CONVERT_REPORT_FILE", "CONVERT_CONFLICT_POLICY", "V2_PRESERVE_LABEL", "TILLER_OUT_CLUSTER", "V2_RELEASE_PATH"}
 )
 
 // The Config struct captures the `settings` and `environment` blocks in the application's drone
@@ -26,51 +29,106 @@ var (
 // not have the `PLUGIN_` prefix.
 type Config struct {
 	// Configuration for drone-helm itself
-	Command             string   `envconfig:"mode"`                   // Helm command to run
-	DroneEvent          string   `envconfig:"drone_build_event"`      // Drone event that invoked this plugin.
-	UpdateDependencies  bool     `split_words:"true"`                 // [Deprecated] Call `helm dependency update` before the main command (deprecated, use dependencies_action: update instead)
-	DependenciesAction  string   `split_words:"true"`                 // Call `helm dependency build` or `helm dependency update` before the main command
-	AddRepos            []string `split_words:"true"`                 // Call `helm repo add` before the main command
-	RepoCertificate     string   `envconfig:"repo_certificate"`       // The Helm chart repository's self-signed certificate (must be base64-encoded)
-	RepoCACertificate   string   `envconfig:"repo_ca_certificate"`    // The Helm chart repository CA's self-signed certificate (must be base64-encoded)
-	Debug               bool     ``                                   // Generate debug output and pass --debug to all helm commands
-	Values              string   ``                                   // Argument to pass to --set in applicable helm commands
-	StringValues        string   `split_words:"true"`                 // Argument to pass to --set-string in applicable helm commands
-	ValuesFiles         []string `split_words:"true"`                 // Arguments to pass to --values in applicable helm commands
-	Namespace           string   ``                                   // Kubernetes namespace for all helm commands
-	CreateNamespace     bool     `split_words:"true"`                 // Pass --create-namespace to `helm upgrade`
-	KubeToken           string   `split_words:"true"`                 // Kubernetes authentication token to put in .kube/config
-	SkipKubeconfig      bool     `envconfig:"skip_kubeconfig"`        // Skip kubeconfig creation
-	SkipTLSVerify       bool     `envconfig:"skip_tls_verify"`        // Put insecure-skip-tls-verify in .kube/config
-	Certificate         string   `envconfig:"kube_certificate"`       // The Kubernetes cluster CA's self-signed certificate (must be base64-encoded)
-	APIServer           string   `envconfig:"kube_api_server"`        // The Kubernetes cluster's API endpoint
-	ServiceAccount      string   `envconfig:"kube_service_account"`   // Account to use for connecting to the Kubernetes cluster
-	ChartVersion        string   `split_words:"true"`                 // Specific chart version to use in `helm upgrade`
-	DryRun              bool     `split_words:"true"`                 // Pass --dry-run to applicable helm commands
-	Wait                bool     `envconfig:"wait_for_upgrade"`       // Pass --wait to applicable helm commands
-	ReuseValues         bool     `split_words:"true"`                 // Pass --reuse-values to `helm upgrade`
-	KeepHistory         bool     `split_words:"true"`                 // Pass --keep-history to `helm uninstall`
-	HistoryMax          int      `split_words:"true"`                 // Pass --history-max option
-	Timeout             string   ``                                   // Argument to pass to --timeout in applicable helm commands
-	Chart               string   ``                                   // Chart argument to use in applicable helm commands
-	Release             string   ``                                   // Release argument to use in applicable helm commands
-	Force               bool     `envconfig:"force_upgrade"`          // Pass --force to applicable helm commands
-	AtomicUpgrade       bool     `split_words:"true"`                 // Pass --atomic to `helm upgrade`
-	CleanupOnFail       bool     `envconfig:"cleanup_failed_upgrade"` // Pass --cleanup-on-fail to `helm upgrade`
-	LintStrictly        bool     `split_words:"true"`                 // Pass --strict to `helm lint`
-	SkipCrds            bool     `split_words:"true"`                 // Pass --skip-crds to `helm upgrade`
-	DisableV2Conversion bool     `split_words:"true"`                 // Whether or not to use 2to3 convert to migrate Releases from v2 to v3
-	DeleteV2Releases    bool     `split_words:"true"`                 // Pass --delete-v2-releases option for 2to3 convert command
-	MaxReleaseVersions  int      `split_words:"true"`                 // Pass --release-versions-max option for 2to3 convert command
-	TillerNS            string   `envconfig:"tiller_ns"`              // Tiller namespace (--tiller-ns) for 2to3 convert command
-	TillerLabel         string   `split_words:"true"`                 // Tiller label selector (--label) for 2to3 convert command
+	Command               string        `envconfig:"mode"`                   // Helm command to run
+	EventModes            EventModes    `split_words:"true"`                 // Modes to run for Drone events, overriding the built-in choices
+	SkipUnmappedEvents    bool          `split_words:"true"`                 // Succeed without doing anything for events that don't have a mode
+	ConfigFile            string        `split_words:"true"`                 // YAML file with default settings, overridden by the pipeline's settings
+	DroneEvent            string        `envconfig:"drone_build_event"`      // Drone event that invoked this plugin.
+	DeployTo              string        `envconfig:"drone_deploy_to"`        // Target environment of a Drone promotion
+	Branch                string        `envconfig:"drone_branch"`           // Branch that Drone is building
+	Tag                   string        `envconfig:"drone_tag"`              // Tag that Drone is building
+	Commit                string        `envconfig:"drone_commit_sha"`       // Commit that Drone is building
+	BuildNumber           string        `envconfig:"drone_build_number"`     // Number of the Drone build
+	Repo                  string        `envconfig:"drone_repo"`             // Repository that Drone is building
+	PullRequest           string        `envconfig:"drone_pull_request"`     // Number of the pull request that Drone is building
+	UpdateDependencies    bool          `split_words:"true"`                 // [Deprecated] Call `helm dependency update` before the main command (deprecated, use dependencies_action: update instead)
+	DependenciesAction    string        `split_words:"true"`                 // Call `helm dependency build` or `helm dependency update` before the main command
+	AddRepos              []string      `split_words:"true"`                 // Call `helm repo add` before the main command
+	RepoCertificate       string        `envconfig:"repo_certificate"`       // The Helm chart repository's self-signed certificate (must be base64-encoded)
+	RepoCACertificate     string        `envconfig:"repo_ca_certificate"`    // The Helm chart repository CA's self-signed certificate (must be base64-encoded)
+	Debug                 bool          ``                                   // Generate debug output and pass --debug to all helm commands
+	Values                ValueList     ``                                   // Arguments to pass to --set in applicable helm commands
+	StringValues          ValueList     `split_words:"true"`                 // Arguments to pass to --set-string in applicable helm commands
+	SetJSON               JSONValueList `envconfig:"set_json"`               // Arguments to pass to --set-json in applicable helm commands
+	SetFile               ValueList     `envconfig:"set_file"`               // Arguments to pass to --set-file in applicable helm commands
+	ValuesFiles           []string      `split_words:"true"`                 // Arguments to pass to --values in applicable helm commands
+	Namespace             string        ``                                   // Kubernetes namespace for all helm commands
+	CreateNamespace       bool          `split_words:"true"`                 // Pass --create-namespace to `helm upgrade`
+	KubeToken             string        `split_words:"true"`                 // Kubernetes authentication token to put in .kube/config
+	SkipKubeconfig        bool          `envconfig:"skip_kubeconfig"`        // Skip kubeconfig creation
+	KubeConfigTemplate    string        `envconfig:"kube_config_template"`   // Template used to generate the kubeconfig file
+	KubeConfigPath        string        `envconfig:"kube_config_path"`       // Where to write the kubeconfig file; passed to --kubeconfig in all helm commands
+	SkipTLSVerify         bool          `envconfig:"skip_tls_verify"`        // Put insecure-skip-tls-verify in .kube/config
+	Certificate           string        `envconfig:"kube_certificate"`       // The Kubernetes cluster CA's self-signed certificate (must be base64-encoded)
+	CertificateFile       string        `envconfig:"kube_certificate_file"`  // Path to the Kubernetes cluster CA's certificate file
+	APIServer             string        `envconfig:"kube_api_server"`        // The Kubernetes cluster's API endpoint
+	ProxyURL              string        `envconfig:"kube_proxy_url"`         // Proxy to use for requests to the Kubernetes API
+	TLSServerName         string        `envconfig:"kube_tls_server_name"`   // Server name to verify the Kubernetes API's certificate against
+	ServiceAccount        string        `envconfig:"kube_service_account"`   // Account to use for connecting to the Kubernetes cluster
+	ChartVersion          string        `split_words:"true"`                 // Specific chart version to use in `helm upgrade`
+	DryRun                bool          `split_words:"true"`                 // Pass --dry-run to applicable helm commands
+	Wait                  bool          `envconfig:"wait_for_upgrade"`       // Pass --wait to applicable helm commands
+	ReuseValues           bool          `split_words:"true"`                 // Pass --reuse-values to `helm upgrade`
+	KeepHistory           bool          `split_words:"true"`                 // Pass --keep-history to `helm uninstall`
+	HistoryMax            int           `split_words:"true"`                 // Pass --history-max option
+	Timeout               string        ``                                   // Argument to pass to --timeout in applicable helm commands
+	Chart                 string        ``                                   // Chart argument to use in applicable helm commands; a list or glob of charts to lint
+	Release               string        ``                                   // Release argument to use in applicable helm commands
+	Force                 bool          `envconfig:"force_upgrade"`          // Pass --force to applicable helm commands
+	AtomicUpgrade         bool          `split_words:"true"`                 // Pass --atomic to `helm upgrade`
+	CleanupOnFail         bool          `envconfig:"cleanup_failed_upgrade"` // Pass --cleanup-on-fail to `helm upgrade`
+	LintStrictly          bool          `split_words:"true"`                 // Pass --strict to `helm lint`
+	LintMatrix            LintMatrix    `split_words:"true"`                 // Sets of values files to lint each chart with, on top of values_files
+	ValidateSchemas       bool          `split_words:"true"`                 // Check the resources each chart renders against Kubernetes' JSON schemas when linting
+	KubeVersion           string        `split_words:"true"`                 // Kubernetes version whose schemas validate_schemas uses
+	SchemaLocation        string        `split_words:"true"`                 // Directory of offline Kubernetes JSON schemas for validate_schemas
+	SkipCrds              bool          `split_words:"true"`                 // Pass --skip-crds to `helm upgrade`
+	OnFailure             []string      `split_words:"true"`                 // What to do when `helm upgrade` fails: diagnose, rollback, or both
+	FailureLogLines       int           `split_words:"true"`                 // How many log lines on_failure's diagnostics show for each failing container
+	InjectBuildMetadata   bool          `split_words:"true"`                 // Pass the Drone build's details to `helm upgrade` as values and a release description
+	BuildMetadataPrefix   string        `split_words:"true"`                 // Key under which inject_build_metadata puts its values
+	Preflight             bool          ``                                   // Check cluster connectivity and RBAC permissions before upgrading
+	SourceRelease         string        `envconfig:"source_release"`         // Release whose chart and values promote mode deploys
+	SourceNamespace       string        `envconfig:"source_namespace"`       // Namespace of source_release
+	SourceKubeConfig      string        `envconfig:"source_kube_config"`     // Kubeconfig file for the cluster with source_release
+	SourceKubeContext     string        `envconfig:"source_kube_context"`    // Kubeconfig context for the cluster with source_release
+	PreviewTTL            string        `envconfig:"preview_ttl"`            // How long a preview environment lives before preview_cleanup removes it
+	PreviewEnvFile        string        `envconfig:"preview_env_file"`       // Where preview mode writes the preview environment's release and namespace names
+	StrictSettings        bool          `split_words:"true"`                 // Fail, rather than warn, when a setting isn't recognized
+	DisableV2Conversion   bool          `split_words:"true"`                 // Whether or not to use 2to3 convert to migrate Releases from v2 to v3
+	DeleteV2Releases      bool          `split_words:"true"`                 // Pass --delete-v2-releases option for 2to3 convert command
+	MaxReleaseVersions    int           `split_words:"true"`                 // Pass --release-versions-max option for 2to3 convert command
+	TillerNS              string        `envconfig:"tiller_ns"`              // Tiller namespace (--tiller-ns) for 2to3 convert command
+	TillerLabel           string        `split_words:"true"`                 // Tiller label selector (--label) for 2to3 convert command
+	TillerStorage         string        `split_words:"true"`                 // Tiller's storage backend, configmap, secret, or local, for 2to3 convert command
+	TillerOutCluster      bool          `split_words:"true"`                 // Tiller runs outside the cluster, so 2to3 takes tiller_storage as given (--tiller-out-cluster)
+	V2ReleasePath         string        `envconfig:"v2_release_path"`        // File or directory of v2 releases to convert when tiller_storage is local
+	ConvertAll            bool          `split_words:"true"`                 // Convert every v2 release in the Tiller namespace, not just the one in release
+	ConvertInclude        []string      `split_words:"true"`                 // Glob patterns for the release names convert_all converts
+	ConvertExclude        []string      `split_words:"true"`                 // Glob patterns for release names convert_all leaves alone
+	ConvertReportFile     string        `split_words:"true"`                 // Where a dry-run conversion writes its JSON report
+	ConvertConflictPolicy string        `split_words:"true"`                 // What conversion does with a release that has both v2 and v3 records: skip, fail, or overwrite
+	V2PreserveLabel       string        `envconfig:"v2_preserve_label"`      // Label, as key=value, that marks the v2 releases conversion keeps
+	V2Retention           string        `envconfig:"v2_retention"`           // How long v2-cleanup keeps converted v2 releases
+	DeleteTiller          bool          `split_words:"true"`                 // Have v2-cleanup delete Tiller's deployment and service
 
 	Stdout io.Writer `ignored:"true"`
 	Stderr io.Writer `ignored:"true"`
+
+	secrets *secrets
 }
 
 // NewConfig creates a Config and reads environment variables into it, accounting for several possible formats.
+// The Config's Stdout and Stderr mask any secrets it knows about in everything written to stdout and stderr.
 func NewConfig(stdout, stderr io.Writer) (*Config, error) {
+	secrets := &secrets{}
+	stdout = newRedactingWriter(stdout, secrets)
+	stderr = newRedactingWriter(stderr, secrets)
+
+	if err := loadConfigFile(); err != nil {
+		return nil, err
+	}
+
 	var aliases settingAliases
 	if err := envconfig.Process("plugin", &aliases); err != nil {
 		return nil, err
@@ -93,8 +151,14 @@ func NewConfig(stdout, stderr io.Writer) (*Config, error) {
 		// set to same default as helm CLI
 		HistoryMax: DefaultHistoryMax,
 
+		BuildMetadataPrefix: DefaultBuildMetadataPrefix,
+		PreviewEnvFile:      DefaultPreviewEnvFile,
+		FailureLogLines:     DefaultFailureLogLines,
+
 		Stdout: stdout,
 		Stderr: stderr,
+
+		secrets: secrets,
 	}
 	if err := envconfig.Process("plugin", &cfg); err != nil {
 		return nil, err
@@ -114,44 +178,65 @@ func NewConfig(stdout, stderr io.Writer) (*Config, error) {
 		cfg.Timeout = fmt.Sprintf("%ss", cfg.Timeout)
 	}
 
-	cfg.loadValuesSecrets()
-
+	// the credentials in the settings are masked from the start, so they stay out of the debug output too, which is
+	// logged before references are resolved so that resolved secrets stay out of it
+	cfg.registerSecrets()
 	if cfg.Debug && cfg.Stderr != nil {
 		cfg.logDebug()
 	}
 
+	if err := cfg.loadValuesSecrets(); err != nil {
+		return nil, err
+	}
+
 	// Deprecation messages
 	cfg.varsMessage(deprecatedVars, "Warning: ignoring deprecated '%s' setting\n")
 
-	if cfg.DisableV2Conversion && (cfg.Command != "convert") {
-		cfg.varsMessage(convertVars, "Warning: ignoring '%s' setting as is only used when 'mode' is 'convert' or 'enable_v2_conversion' is 'true'\n")
+	if mode := cfg.Mode(); cfg.DisableV2Conversion && mode != "convert" && mode != "v2-cleanup" {
+		cfg.varsMessage(convertVars, "Warning: ignoring '%s' setting as is only used when 'mode' is 'convert' or 'v2-cleanup', or 'enable_v2_conversion' is 'true'\n")
+	}
+
+	if err := cfg.validateSettings(); err != nil {
+		return nil, err
 	}
 
 	return &cfg, nil
 }
 
-func (cfg *Config) loadValuesSecrets() {
-	findVar := regexp.MustCompile(`\$\{?(\w+)\}?`)
-
-	replacer := func(varName string) string {
-		sigils := regexp.MustCompile(`[${}]`)
-		varName = sigils.ReplaceAllString(varName, "")
+func (cfg *Config) loadValuesSecrets() error {
+	refs := references{cfg: cfg}
 
-		if value, ok := os.LookupEnv(varName); ok {
-			return value
+	for _, entries := range [][]string{cfg.Values, cfg.StringValues, cfg.SetJSON, cfg.SetFile, cfg.AddRepos} {
+		for i := range entries {
+			var err error
+			if entries[i], err = refs.resolve(entries[i], settingReference); err != nil {
+				return err
+			}
 		}
+	}
+	return nil
+}
 
-		if cfg.Debug {
-			fmt.Fprintf(cfg.Stderr, "$%s not present in environment, replaced with \"\"\n", varName)
+// registerSecrets makes sure credentials from the settings are masked in the plugin's output. Values resolved from
+// references are registered as they're resolved.
+func (cfg *Config) registerSecrets() {
+	cfg.secrets.add(cfg.KubeToken)
+	cfg.secrets.addBase64(cfg.Certificate)
+	cfg.secrets.addBase64(cfg.RepoCertificate)
+	cfg.secrets.addBase64(cfg.RepoCACertificate)
+	for _, repo := range cfg.AddRepos {
+		if _, repoURL, ok := strings.Cut(repo, "="); ok {
+			cfg.secrets.addURLPassword(repoURL)
 		}
-		return ""
 	}
+}
 
-	cfg.Values = findVar.ReplaceAllStringFunc(cfg.Values, replacer)
-	cfg.StringValues = findVar.ReplaceAllStringFunc(cfg.StringValues, replacer)
-
-	for i := 0; i < len(cfg.AddRepos); i++ {
-		cfg.AddRepos[i] = findVar.ReplaceAllStringFunc(cfg.AddRepos[i], replacer)
+// Flush writes out any output that's being held back for redaction. It should be called before the plugin exits.
+func (cfg *Config) Flush() {
+	for _, w := range []io.Writer{cfg.Stdout, cfg.Stderr} {
+		if redacting, ok := w.(*redactingWriter); ok {
+			redacting.Flush()
+		}
 	}
 }
 
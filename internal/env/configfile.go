@@ -0,0 +1,182 @@
+package env
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kelseyhightower/envconfig"
+	"sigs.k8s.io/yaml"
+)
+
+// loadConfigFile reads the settings in the config_file, if there is one, and exports them as PLUGIN_ variables so
+// envconfig treats them like any other setting. Settings from the pipeline always win, so a variable that's already
+// set is left alone.
+//
+// The file's top-level keys are setting names. The optional `events` and `branches` sections hold settings that only
+// apply to a given DRONE_BUILD_EVENT or DRONE_BRANCH; branch names may be glob patterns like `release/*`.
+func loadConfigFile() error {
+	filename, ok := os.LookupEnv("CONFIG_FILE")
+	if !ok {
+		filename = os.Getenv("PLUGIN_CONFIG_FILE")
+	}
+	if filename == "" {
+		return nil
+	}
+
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("could not read config_file: %w", err)
+	}
+	var file map[string]interface{}
+	if err := yaml.Unmarshal(contents, &file); err != nil {
+		return fmt.Errorf("could not parse config_file %s: %w", filename, err)
+	}
+
+	settings := make(map[string]interface{})
+	for key, value := range file {
+		if key != "events" && key != "branches" {
+			settings[key] = value
+		}
+	}
+
+	events, err := overrideSections(file, "events")
+	if err != nil {
+		return fmt.Errorf("in config_file %s: %w", filename, err)
+	}
+	for key, value := range events[os.Getenv("DRONE_BUILD_EVENT")] {
+		settings[key] = value
+	}
+
+	branches, err := overrideSections(file, "branches")
+	if err != nil {
+		return fmt.Errorf("in config_file %s: %w", filename, err)
+	}
+	// apply matching patterns in a stable order, so exact branch names (which sort after most patterns) tend to win
+	patterns := make([]string, 0, len(branches))
+	for pattern := range branches {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, os.Getenv("DRONE_BRANCH")); matched {
+			for key, value := range branches[pattern] {
+				settings[key] = value
+			}
+		}
+	}
+
+	names := settingNames()
+	for key, value := range settings {
+		name := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		if settingPresent(name, names) {
+			continue
+		}
+		if err := os.Setenv("PLUGIN_"+name, settingString(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settingPresent reports whether the pipeline set the setting under any of its names, with or without the PLUGIN_
+// prefix. A setting's aliases count, so `wait` in the pipeline overrides `wait_for_upgrade` in the config file.
+func settingPresent(name string, names map[string][]string) bool {
+	aliases, ok := names[name]
+	if !ok {
+		aliases = []string{name}
+	}
+	for _, alias := range aliases {
+		_, barePresent := os.LookupEnv(alias)
+		_, prefixedPresent := os.LookupEnv("PLUGIN_" + alias)
+		if barePresent || prefixedPresent {
+			return true
+		}
+	}
+	return false
+}
+
+// settingNames maps each setting name, without the PLUGIN_ prefix, to every name of the same setting, including
+// those in settingAliases. The names come from envconfig itself, so they're exactly the ones it reads.
+func settingNames() map[string][]string {
+	keys := &strings.Builder{}
+	format := "{{range .}}{{.Name}} {{usage_key .}}\n{{end}}"
+	for _, spec := range []interface{}{&Config{}, &settingAliases{}} {
+		// the format is fixed and both specs are structs, so this can't fail
+		_ = envconfig.Usagef("plugin", spec, keys, format)
+	}
+
+	byField := make(map[string][]string)
+	for _, line := range strings.Split(keys.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		byField[fields[0]] = append(byField[fields[0]], strings.TrimPrefix(fields[1], "PLUGIN_"))
+	}
+
+	names := make(map[string][]string)
+	for _, aliases := range byField {
+		for _, name := range aliases {
+			names[name] = aliases
+		}
+	}
+	return names
+}
+
+func overrideSections(file map[string]interface{}, name string) (map[string]map[string]interface{}, error) {
+	sections := make(map[string]map[string]interface{})
+	if file[name] == nil {
+		return sections, nil
+	}
+
+	entries, ok := file[name].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must map names to settings", name)
+	}
+	for key, entry := range entries {
+		if entry == nil {
+			continue
+		}
+		settings, ok := entry.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s.%s must be a map of settings", name, key)
+		}
+		sections[key] = settings
+	}
+	return sections, nil
+}
+
+// settingString formats a value from the config file the way Drone formats settings: lists are comma-separated,
+// unless one of their items contains a comma, and maps are JSON-encoded.
+func settingString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, settingString(item))
+		}
+		if joined := strings.Join(items, ","); strings.Count(joined, ",") == len(items)-1 || len(items) == 0 {
+			return joined
+		}
+		return jsonString(items)
+	case map[string]interface{}:
+		return jsonString(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func jsonString(value interface{}) string {
+	// the value came from decoding YAML, so it can always be encoded
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
@@ -0,0 +1,150 @@
+package env
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	redactedSecret = "********"
+
+	// Masking very short values would mangle unrelated output (think of a secret that's just "1"), so they're skipped.
+	minSecretLength = 4
+)
+
+// secrets is the set of values that must never appear in the plugin's output. It's shared by the redacting writers
+// and grows as references are resolved.
+type secrets struct {
+	mu     sync.RWMutex
+	values []string
+}
+
+func (s *secrets) add(values ...string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, value := range values {
+		candidates := []string{value}
+		// multi-line secrets (e.g. certificates) are also masked line by line, in case they're printed differently
+		if strings.Contains(value, "\n") {
+			for _, line := range strings.Split(value, "\n") {
+				if secretLine(line) {
+					candidates = append(candidates, line)
+				}
+			}
+		}
+		for _, candidate := range candidates {
+			candidate = strings.TrimSpace(candidate)
+			if len(candidate) >= minSecretLength && !s.contains(candidate) {
+				s.values = append(s.values, candidate)
+			}
+		}
+	}
+
+	// replace longer secrets first, so a secret that contains another one is masked completely
+	sort.Slice(s.values, func(i, j int) bool { return len(s.values[i]) > len(s.values[j]) })
+}
+
+// secretLine reports whether a line of a multi-line secret is worth masking on its own. PEM armor like
+// `-----BEGIN CERTIFICATE-----` and lines of only punctuation are the same in every secret of their kind, so masking
+// them would hide harmless output, such as other certificates, without protecting anything.
+func secretLine(line string) bool {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "-----BEGIN ") || strings.HasPrefix(line, "-----END ") {
+		return false
+	}
+	return strings.IndexFunc(line, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) >= 0
+}
+
+// addBase64 adds a base64-encoded secret, along with its decoded contents.
+func (s *secrets) addBase64(value string) {
+	s.add(value)
+	if decoded, err := base64.StdEncoding.DecodeString(value); err == nil {
+		s.add(string(decoded))
+	}
+}
+
+// addURLPassword adds the password from a URL's userinfo, e.g. in an add_repos entry.
+func (s *secrets) addURLPassword(rawURL string) {
+	if parsed, err := url.Parse(rawURL); err == nil && parsed.User != nil {
+		if password, ok := parsed.User.Password(); ok {
+			s.add(password)
+		}
+	}
+}
+
+func (s *secrets) contains(value string) bool {
+	for _, existing := range s.values {
+		if existing == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *secrets) redact(b []byte) []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, value := range s.values {
+		b = bytes.ReplaceAll(b, []byte(value), []byte(redactedSecret))
+	}
+	return b
+}
+
+// redactingWriter masks secrets in everything written through it. Output is held back until the end of a line, so a
+// secret can't slip through by being split across two writes; Flush writes out anything left over.
+type redactingWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	secrets *secrets
+	pending []byte
+}
+
+func newRedactingWriter(w io.Writer, s *secrets) io.Writer {
+	if w == nil {
+		return nil
+	}
+	return &redactingWriter{w: w, secrets: s}
+}
+
+// Write always reports the full length of p as written, since callers can't know how much of it was held back.
+func (r *redactingWriter) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pending = append(r.pending, p...)
+	end := bytes.LastIndexByte(r.pending, '\n')
+	if end < 0 {
+		return len(p), nil
+	}
+
+	lines := r.pending[:end+1]
+	r.pending = append([]byte(nil), r.pending[end+1:]...)
+	if _, err := r.w.Write(r.secrets.redact(lines)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes out any partial line that's being held back.
+func (r *redactingWriter) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.pending) == 0 {
+		return nil
+	}
+	_, err := r.w.Write(r.secrets.redact(r.pending))
+	r.pending = nil
+	return err
+}
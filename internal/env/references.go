@@ -0,0 +1,176 @@
+package env
+
+import (
+	ctx "context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var (
+	// settingReference matches `$VAR`, `${VAR}` and `${scheme:argument}` references in settings
+	settingReference = regexp.MustCompile(`\$\{(env|file|base64|k8s):([^}]+)\}|\$\{?(\w+)\}?`)
+	// fileReference only matches `${scheme:argument}`, since values files may legitimately contain things like `$HOME`
+	fileReference = regexp.MustCompile(`\$\{(env|file|base64|k8s):([^}]+)\}`)
+)
+
+// newClientset creates the Kubernetes client used to resolve `${k8s:...}` references. It's a variable so the tests
+// can replace it with a fake.
+var newClientset = func(cfg *Config) (kubernetes.Interface, error) {
+	restConfig, err := cfg.restConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(restConfig)
+}
+
+// references resolves the references in settings and values files.
+type references struct {
+	cfg       *Config
+	clientset kubernetes.Interface
+}
+
+// ResolveReferences replaces the `${env:VAR}`, `${file:/path}`, `${base64:VAR}` and `${k8s:secret/name#key}`
+// references in a value from a values file.
+func (cfg Config) ResolveReferences(contents string) (string, error) {
+	refs := references{cfg: &cfg}
+	return refs.resolve(contents, fileReference)
+}
+
+func (r *references) resolve(s string, pattern *regexp.Regexp) (string, error) {
+	var resolveErr error
+	resolved := pattern.ReplaceAllStringFunc(s, func(ref string) string {
+		if resolveErr != nil {
+			return ""
+		}
+		match := pattern.FindStringSubmatch(ref)
+		scheme, argument := match[1], match[2]
+		if scheme == "" {
+			scheme, argument = "env", match[3]
+		}
+
+		value, err := r.lookup(scheme, argument)
+		if err != nil {
+			resolveErr = err
+		}
+		r.cfg.secrets.add(value)
+		return value
+	})
+	if resolveErr != nil {
+		return "", resolveErr
+	}
+	return resolved, nil
+}
+
+func (r *references) lookup(scheme, argument string) (string, error) {
+	switch scheme {
+	case "file":
+		contents, err := os.ReadFile(argument)
+		if err != nil {
+			return "", fmt.Errorf("could not resolve ${file:%s}: %w", argument, err)
+		}
+		return strings.TrimRight(string(contents), "\r\n"), nil
+	case "base64":
+		decoded, err := base64.StdEncoding.DecodeString(r.env(argument))
+		if err != nil {
+			return "", fmt.Errorf("could not resolve ${base64:%s}: %w", argument, err)
+		}
+		return string(decoded), nil
+	case "k8s":
+		return r.secret(argument)
+	default:
+		return r.env(argument), nil
+	}
+}
+
+func (r *references) env(varName string) string {
+	if value, ok := os.LookupEnv(varName); ok {
+		return value
+	}
+
+	if r.cfg.Debug {
+		fmt.Fprintf(r.cfg.Stderr, "$%s not present in environment, replaced with \"\"\n", varName)
+	}
+	return ""
+}
+
+// secret looks up a reference in the form `secret/name#key` in the target namespace.
+func (r *references) secret(ref string) (string, error) {
+	kind, remainder, _ := strings.Cut(ref, "/")
+	name, key, hasKey := strings.Cut(remainder, "#")
+	if kind != "secret" || name == "" || !hasKey || key == "" {
+		return "", fmt.Errorf("could not resolve ${k8s:%s}: references must look like ${k8s:secret/name#key}", ref)
+	}
+
+	if r.clientset == nil {
+		clientset, err := newClientset(r.cfg)
+		if err != nil {
+			return "", fmt.Errorf("could not resolve ${k8s:%s}: %w", ref, err)
+		}
+		r.clientset = clientset
+	}
+
+	namespace := r.cfg.Namespace
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	secret, err := r.clientset.CoreV1().Secrets(namespace).Get(ctx.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("could not resolve ${k8s:%s}: %w", ref, err)
+	}
+	value, ok := secret.Data[key]
+	if !ok {
+		return "", fmt.Errorf("could not resolve ${k8s:%s}: secret %s/%s has no key %s", ref, namespace, name, key)
+	}
+	return string(value), nil
+}
+
+// restConfig builds an API client configuration from the kubeconfig-related settings, since references are resolved
+// before the kubeconfig file is written.
+func (cfg *Config) restConfig() (*rest.Config, error) {
+	if cfg.SkipKubeconfig {
+		rules := clientcmd.NewDefaultClientConfigLoadingRules()
+		rules.ExplicitPath = cfg.KubeConfigPath
+		return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	}
+
+	if cfg.APIServer == "" {
+		return nil, fmt.Errorf("kube_api_server is required to read secrets from Kubernetes")
+	}
+	restConfig := &rest.Config{
+		Host:        cfg.APIServer,
+		BearerToken: cfg.KubeToken,
+		TLSClientConfig: rest.TLSClientConfig{
+			Insecure:   cfg.SkipTLSVerify,
+			ServerName: cfg.TLSServerName,
+		},
+	}
+	if !cfg.SkipTLSVerify {
+		if cfg.Certificate != "" {
+			caData, err := base64.StdEncoding.DecodeString(cfg.Certificate)
+			if err != nil {
+				return nil, fmt.Errorf("failed to base64-decode kube_certificate: %w", err)
+			}
+			restConfig.TLSClientConfig.CAData = caData
+		} else {
+			restConfig.TLSClientConfig.CAFile = cfg.CertificateFile
+		}
+	}
+	if cfg.ProxyURL != "" {
+		proxyURL, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid kube_proxy_url: %w", err)
+		}
+		restConfig.Proxy = http.ProxyURL(proxyURL)
+	}
+	return restConfig, nil
+}
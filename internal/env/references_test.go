@@ -0,0 +1,106 @@
+package env
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type ReferencesTestSuite struct {
+	suite.Suite
+	originalNewClientset func(*Config) (kubernetes.Interface, error)
+}
+
+func TestReferencesTestSuite(t *testing.T) {
+	suite.Run(t, new(ReferencesTestSuite))
+}
+
+func (suite *ReferencesTestSuite) BeforeTest(_, _ string) {
+	suite.originalNewClientset = newClientset
+	newClientset = func(cfg *Config) (kubernetes.Interface, error) {
+		return fake.NewSimpleClientset(&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "palantir", Namespace: "orthanc"},
+			Data:       map[string][]byte{"seer": []byte("Saruman")},
+		}), nil
+	}
+}
+
+func (suite *ReferencesTestSuite) AfterTest(_, _ string) {
+	newClientset = suite.originalNewClientset
+}
+
+func (suite *ReferencesTestSuite) TestResolveSettingReferences() {
+	passwordFile := filepath.Join(suite.T().TempDir(), "password")
+	suite.Require().NoError(os.WriteFile(passwordFile, []byte("mellon\n"), 0600))
+	suite.T().Setenv("SECRET_RING", base64.StdEncoding.EncodeToString([]byte("one, to rule them all")))
+	suite.T().Setenv("SECRET_FIRE", "Anor")
+
+	refs := references{cfg: &Config{Namespace: "orthanc"}}
+	resolved, err := refs.resolve(strings.Join([]string{
+		"door=${file:" + passwordFile + "}",
+		"ring=${base64:SECRET_RING}",
+		"seer=${k8s:secret/palantir#seer}",
+		"fire=$SECRET_FIRE",
+		"flame=${env:SECRET_FIRE}",
+	}, ","), settingReference)
+
+	suite.Require().NoError(err)
+	suite.Equal("door=mellon,ring=one, to rule them all,seer=Saruman,fire=Anor,flame=Anor", resolved)
+}
+
+func (suite *ReferencesTestSuite) TestResolveReferencesLeavesBareVariables() {
+	suite.T().Setenv("SECRET_FIRE", "Anor")
+
+	resolved, err := Config{}.ResolveReferences("fire: ${env:SECRET_FIRE}\npath: $PATH\n")
+	suite.Require().NoError(err)
+	suite.Equal("fire: Anor\npath: $PATH\n", resolved)
+}
+
+func (suite *ReferencesTestSuite) TestResolveErrors() {
+	refs := references{cfg: &Config{Namespace: "orthanc"}}
+
+	_, err := refs.resolve("${file:/usr/foreign/exclude/password}", settingReference)
+	suite.Regexp(`could not resolve \$\{file:/usr/foreign/exclude/password\}: .* no such file or directory`, err)
+
+	suite.T().Setenv("SECRET_RING", "not base64!")
+	_, err = refs.resolve("${base64:SECRET_RING}", settingReference)
+	suite.Regexp(`could not resolve \$\{base64:SECRET_RING\}: illegal base64 data`, err)
+
+	_, err = refs.resolve("${k8s:configmap/palantir#seer}", settingReference)
+	suite.EqualError(err, "could not resolve ${k8s:configmap/palantir#seer}: references must look like ${k8s:secret/name#key}")
+
+	_, err = refs.resolve("${k8s:secret/palantir#owner}", settingReference)
+	suite.EqualError(err, "could not resolve ${k8s:secret/palantir#owner}: secret orthanc/palantir has no key owner")
+
+	_, err = refs.resolve("${k8s:secret/silmaril#light}", settingReference)
+	suite.EqualError(err, `could not resolve ${k8s:secret/silmaril#light}: secrets "silmaril" not found`)
+}
+
+func (suite *ReferencesTestSuite) TestRestConfig() {
+	cfg := Config{
+		APIServer:     "https://orthanc.isengard",
+		KubeToken:     "c3BlYWsgZnJpZW5k",
+		Certificate:   base64.StdEncoding.EncodeToString([]byte("ithildin")),
+		TLSServerName: "orthanc",
+		ProxyURL:      "http://minas.morgul:3128",
+	}
+	restConfig, err := cfg.restConfig()
+	suite.Require().NoError(err)
+
+	suite.Equal("https://orthanc.isengard", restConfig.Host)
+	suite.Equal("c3BlYWsgZnJpZW5k", restConfig.BearerToken)
+	suite.Equal([]byte("ithildin"), restConfig.TLSClientConfig.CAData)
+	suite.Equal("orthanc", restConfig.TLSClientConfig.ServerName)
+	suite.NotNil(restConfig.Proxy)
+
+	_, err = (&Config{}).restConfig()
+	suite.EqualError(err, "kube_api_server is required to read secrets from Kubernetes")
+}
@@ -0,0 +1,193 @@
+package env
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// validModes lists the modes the mode setting and event_modes can choose.
+var validModes = []string{"upgrade", "uninstall", "delete", "lint", "convert", "v2-cleanup", "preview", "preview_cleanup",
+	"promote", "help"}
+
+// modeVars lists settings that are only used by some modes. Settings that are used by every mode aren't listed.
+var modeVars = []struct {
+	modes []string
+	vars  []string
+}{
+	{
+		modes: []string{"upgrade", "preview"},
+		vars:  []string{"CHART_VERSION", "PREFLIGHT"},
+	},
+	{
+		modes: []string{"upgrade", "preview", "promote"},
+		vars: []string{"REUSE_VALUES", "FORCE_UPGRADE", "FORCE", "ATOMIC_UPGRADE", "CLEANUP_FAILED_UPGRADE", "HISTORY_MAX",
+			"CREATE_NAMESPACE", "SKIP_CRDS", "WAIT_FOR_UPGRADE", "WAIT", "TIMEOUT", "INJECT_BUILD_METADATA",
+			"BUILD_METADATA_PREFIX", "ON_FAILURE", "FAILURE_LOG_LINES"},
+	},
+	{
+		modes: []string{"upgrade", "preview"},
+		vars:  []string{"DEPENDENCIES_ACTION"},
+	},
+	{
+		modes: []string{"upgrade", "preview", "lint", "uninstall"},
+		vars:  []string{"CHART", "UPDATE_DEPENDENCIES"},
+	},
+	{
+		modes: []string{"upgrade", "preview", "promote", "lint"},
+		vars:  []string{"VALUES", "STRING_VALUES", "SET_JSON", "SET_FILE", "VALUES_FILES"},
+	},
+	{
+		modes: []string{"promote"},
+		vars:  []string{"SOURCE_RELEASE", "SOURCE_NAMESPACE", "SOURCE_KUBE_CONFIG", "SOURCE_KUBE_CONTEXT"},
+	},
+	{
+		modes: []string{"convert"},
+		vars:  []string{"CONVERT_ALL", "CONVERT_INCLUDE", "CONVERT_EXCLUDE"},
+	},
+	{
+		modes: []string{"v2-cleanup"},
+		vars:  []string{"V2_RETENTION", "DELETE_TILLER"},
+	},
+	{
+		modes: []string{"uninstall"},
+		vars:  []string{"KEEP_HISTORY"},
+	},
+	{
+		modes: []string{"lint"},
+		vars:  []string{"LINT_STRICTLY", "LINT_MATRIX", "VALIDATE_SCHEMAS", "KUBE_VERSION", "SCHEMA_LOCATION"},
+	},
+	{
+		modes: []string{"preview"},
+		vars:  []string{"PREVIEW_TTL", "PREVIEW_ENV_FILE"},
+	},
+}
+
+// validateSettings warns about settings that are misspelled or don't apply to the current mode. Misspelled settings
+// are an error when strict_settings is true.
+func (cfg *Config) validateSettings() error {
+	unknown := unknownSettings()
+	for _, message := range unknown {
+		if !cfg.StrictSettings {
+			fmt.Fprintf(cfg.Stderr, "Warning: ignoring unknown setting %s\n", message)
+		}
+	}
+	if cfg.StrictSettings && len(unknown) > 0 {
+		return fmt.Errorf("unknown setting(s): %s", strings.Join(unknown, ", "))
+	}
+
+	mode := cfg.Mode()
+	if mode == "help" || mode == "skip" {
+		return nil
+	}
+	for _, mv := range modeVars {
+		if !contains(mv.modes, mode) {
+			cfg.varsMessage(mv.vars, fmt.Sprintf("Warning: ignoring '%%s' setting as it is only used when 'mode' is '%s'\n",
+				strings.Join(mv.modes, "' or '")))
+		}
+	}
+	return nil
+}
+
+// Mode is the helm command the plugin will run: one of the mode setting's values, with "delete" meaning "uninstall",
+// or "skip" when skip_unmapped_events applies. It comes from the mode setting, then event_modes, then the Drone event,
+// and is "help" when none of them says what to do.
+func (cfg Config) Mode() string {
+	command := cfg.Command
+	// event_modes takes priority over the built-in choices below
+	if mode, ok := cfg.EventModes[cfg.DroneEvent]; ok && command == "" {
+		command = mode
+	}
+
+	switch {
+	case command == "delete":
+		return "uninstall"
+	case contains(validModes, command):
+		return command
+	}
+	switch cfg.DroneEvent {
+	case "push", "tag", "deployment", "pull_request", "promote", "rollback":
+		return "upgrade"
+	case "delete":
+		return "uninstall"
+	}
+	if command == "" && cfg.SkipUnmappedEvents {
+		return "skip"
+	}
+	return "help"
+}
+
+// unknownSettings describes each PLUGIN_ variable that doesn't correspond to a setting, with a suggestion when there's a
+// setting with a similar name.
+func unknownSettings() []string {
+	known := knownSettings()
+
+	var unknown []string
+	for _, entry := range os.Environ() {
+		key, _, _ := strings.Cut(entry, "=")
+		name := strings.TrimPrefix(key, "PLUGIN_")
+		if name == key || contains(known, name) {
+			continue
+		}
+
+		message := fmt.Sprintf("'%s'", strings.ToLower(name))
+		if suggestion := closest(name, known); suggestion != "" {
+			message += fmt.Sprintf(" (did you mean '%s'?)", strings.ToLower(suggestion))
+		}
+		unknown = append(unknown, message)
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// knownSettings lists the names of all settings, without the PLUGIN_ prefix, in order.
+func knownSettings() []string {
+	var known []string
+	for name := range settingNames() {
+		known = append(known, name)
+	}
+	sort.Strings(known)
+	return append(append(known, deprecatedVars...), convertVars...)
+}
+
+// closest finds the name that's nearest to the given one, as long as it's near enough to plausibly be a typo.
+func closest(name string, candidates []string) string {
+	best, bestDistance := "", len(name)/3+1
+	for _, candidate := range candidates {
+		if distance := levenshtein(name, candidate); distance < bestDistance {
+			best, bestDistance = candidate, distance
+		}
+	}
+	return best
+}
+
+func levenshtein(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
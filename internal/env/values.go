@@ -0,0 +1,178 @@
+package env
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ValueList holds the entries for one of helm's --set flags, each in helm's `key=value` syntax. Drone joins lists
+// with commas, which is ambiguous when a value contains a comma, so a ValueList can also be given as a JSON array of
+// `key=value` strings, which are passed to helm as written, so helm's own syntax like `tags={a,b}` still works, or as a
+// JSON object, whose values are escaped so helm reads each one as a single value. Anything else is a single entry
+// that's passed to helm unchanged, as it always has been.
+type ValueList []string
+
+// Decode implements envconfig.Decoder.
+func (v *ValueList) Decode(value string) error {
+	entries, err := decodeValueList(value, func(key string, val interface{}) (string, error) {
+		switch val := val.(type) {
+		case map[string]interface{}, []interface{}:
+			return "", fmt.Errorf("the value of %s is a structure; use set_json for structured values", key)
+		case string:
+			return EscapeValue(val), nil
+		default:
+			// numbers, booleans and null are written the way helm parses them
+			encoded, err := json.Marshal(val)
+			return string(encoded), err
+		}
+	})
+	*v = entries
+	return err
+}
+
+// JSONValueList holds the entries for helm's --set-json flag. It accepts the same forms as ValueList, but the values
+// in a JSON object are passed to helm as JSON.
+type JSONValueList []string
+
+// Decode implements envconfig.Decoder.
+func (v *JSONValueList) Decode(value string) error {
+	entries, err := decodeValueList(value, func(_ string, val interface{}) (string, error) {
+		encoded, err := json.Marshal(val)
+		return string(encoded), err
+	})
+	*v = entries
+	return err
+}
+
+// decodeValueList splits a setting into entries. Entries in a JSON array are used as they are, and the values in a
+// JSON object are passed through format.
+func decodeValueList(value string, format func(string, interface{}) (string, error)) ([]string, error) {
+	trimmed := strings.TrimSpace(value)
+	switch {
+	case trimmed == "":
+		return nil, nil
+	case strings.HasPrefix(trimmed, "["):
+		var entries []string
+		if err := json.Unmarshal([]byte(trimmed), &entries); err == nil {
+			return entries, nil
+		}
+	case strings.HasPrefix(trimmed, "{"):
+		var object map[string]interface{}
+		if err := json.Unmarshal([]byte(trimmed), &object); err == nil {
+			entries := make([]string, 0, len(object))
+			for key, val := range object {
+				formatted, err := format(key, val)
+				if err != nil {
+					return nil, err
+				}
+				entries = append(entries, key+"="+formatted)
+			}
+			sort.Strings(entries)
+			return entries, nil
+		}
+	}
+
+	// not JSON, so it's the traditional comma-separated form
+	return []string{value}, nil
+}
+
+// EscapeValue escapes the characters that helm's --set parser treats specially in values.
+func EscapeValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`).Replace(value)
+}
+
+// EventModes maps Drone events to the modes they should run. It can be given as a JSON object, which is how Drone
+// passes maps, or as comma-separated `event:mode` pairs.
+type EventModes map[string]string
+
+// Decode implements envconfig.Decoder.
+func (em *EventModes) Decode(value string) error {
+	modes := make(map[string]string)
+	if strings.HasPrefix(strings.TrimSpace(value), "{") {
+		if err := json.Unmarshal([]byte(value), &modes); err != nil {
+			return fmt.Errorf("invalid event_modes: %w", err)
+		}
+	} else {
+		for _, pair := range strings.Split(value, ",") {
+			if strings.TrimSpace(pair) == "" {
+				continue
+			}
+			event, mode, ok := strings.Cut(pair, ":")
+			if !ok {
+				return fmt.Errorf("invalid event_modes entry %q: must be event:mode", pair)
+			}
+			modes[strings.TrimSpace(event)] = strings.TrimSpace(mode)
+		}
+	}
+
+	// a misspelled mode would otherwise fall back to the event's built-in choice, which is usually an upgrade
+	events := make([]string, 0, len(modes))
+	for event := range modes {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+	for _, event := range events {
+		if mode := modes[event]; !contains(validModes, mode) {
+			message := fmt.Sprintf("invalid event_modes entry %q: unknown mode '%s'", event+":"+mode, mode)
+			if suggestion := closest(mode, validModes); suggestion != "" {
+				message += fmt.Sprintf(" (did you mean '%s'?)", suggestion)
+			}
+			return fmt.Errorf("%s", message)
+		}
+	}
+
+	*em = modes
+	return nil
+}
+
+// LintMatrix holds the sets of values files that lint mode lints each chart with. Drone passes a list of lists as a
+// JSON array, in which each set is an array of files or a string of comma-separated ones. Anything else is a
+// comma-separated list of sets with one file each.
+type LintMatrix [][]string
+
+// Decode implements envconfig.Decoder.
+func (s *LintMatrix) Decode(value string) error {
+	split := func(set string) []string {
+		var files []string
+		for _, file := range strings.Split(set, ",") {
+			if file = strings.TrimSpace(file); file != "" {
+				files = append(files, file)
+			}
+		}
+		return files
+	}
+
+	var sets [][]string
+	if trimmed := strings.TrimSpace(value); strings.HasPrefix(trimmed, "[") {
+		var entries []interface{}
+		if err := json.Unmarshal([]byte(trimmed), &entries); err != nil {
+			return fmt.Errorf("invalid lint_matrix: %w", err)
+		}
+		for _, entry := range entries {
+			switch entry := entry.(type) {
+			case string:
+				sets = append(sets, split(entry))
+			case []interface{}:
+				var files []string
+				for _, file := range entry {
+					name, ok := file.(string)
+					if !ok {
+						return fmt.Errorf("invalid lint_matrix entry %v: must be a list of files", entry)
+					}
+					files = append(files, name)
+				}
+				sets = append(sets, files)
+			default:
+				return fmt.Errorf("invalid lint_matrix entry %v: must be a list of files", entry)
+			}
+		}
+	} else {
+		for _, file := range split(value) {
+			sets = append(sets, []string{file})
+		}
+	}
+	*s = sets
+	return nil
+}
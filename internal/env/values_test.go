@@ -0,0 +1,82 @@
+package env
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ValuesTestSuite struct {
+	suite.Suite
+}
+
+func TestValuesTestSuite(t *testing.T) {
+	suite.Run(t, new(ValuesTestSuite))
+}
+
+func (suite *ValuesTestSuite) TestDecodeCommaSeparated() {
+	var values ValueList
+	suite.Require().NoError(values.Decode("image.tag=1.2,replicas=3"))
+	suite.Equal(ValueList{"image.tag=1.2,replicas=3"}, values)
+}
+
+func (suite *ValuesTestSuite) TestDecodeArray() {
+	var values ValueList
+	suite.Require().NoError(values.Decode(`["ingress.hosts={a.example.com,b.example.com}","greeting=hello\\, world"]`))
+	suite.Equal(ValueList{"ingress.hosts={a.example.com,b.example.com}", `greeting=hello\, world`}, values,
+		"list entries are in helm's syntax, so they should be passed on as they are")
+}
+
+func (suite *ValuesTestSuite) TestDecodeObject() {
+	var values ValueList
+	suite.Require().NoError(values.Decode(`{"greeting": "hello, world", "replicas": 3, "debug": true, "path": "C:\\charts"}`))
+	suite.Equal(ValueList{"debug=true", `greeting=hello\, world`, `path=C:\\charts`, "replicas=3"}, values)
+
+	suite.EqualError(values.Decode(`{"resources": {"cpu": "1"}}`),
+		"the value of resources is a structure; use set_json for structured values")
+}
+
+func (suite *ValuesTestSuite) TestDecodeInvalidJSON() {
+	var values ValueList
+	suite.Require().NoError(values.Decode("{not json"))
+	suite.Equal(ValueList{"{not json"}, values)
+}
+
+func (suite *ValuesTestSuite) TestDecodeJSONValues() {
+	var values JSONValueList
+	suite.Require().NoError(values.Decode(`{"resources": {"cpu": "1"}, "hosts": ["a", "b"]}`))
+	suite.Equal(JSONValueList{`hosts=["a","b"]`, `resources={"cpu":"1"}`}, values)
+
+	suite.Require().NoError(values.Decode(`["resources={\"cpu\":\"1\",\"memory\":\"1Gi\"}"]`))
+	suite.Equal(JSONValueList{`resources={"cpu":"1","memory":"1Gi"}`}, values)
+}
+
+func (suite *ValuesTestSuite) TestDecodeEventModes() {
+	var modes EventModes
+	suite.Require().NoError(modes.Decode(`{"pull_request": "lint", "cron": "preview_cleanup"}`))
+	suite.Equal(EventModes{"pull_request": "lint", "cron": "preview_cleanup"}, modes)
+
+	suite.Require().NoError(modes.Decode("pull_request:lint, cron:preview_cleanup"))
+	suite.Equal(EventModes{"pull_request": "lint", "cron": "preview_cleanup"}, modes)
+
+	suite.EqualError(modes.Decode("pull_request=lint"), `invalid event_modes entry "pull_request=lint": must be event:mode`)
+	suite.EqualError(modes.Decode(`{"pull_request": "lnt", "cron": "preview_cleanup"}`),
+		`invalid event_modes entry "pull_request:lnt": unknown mode 'lnt' (did you mean 'lint'?)`)
+	suite.EqualError(modes.Decode("push:deploy"), `invalid event_modes entry "push:deploy": unknown mode 'deploy'`)
+}
+
+func (suite *ValuesTestSuite) TestDecodeLintMatrix() {
+	var sets LintMatrix
+	suite.Require().NoError(sets.Decode(`[["values.yaml", "values-prod.yaml"], ["values.yaml", "values-staging.yaml"]]`))
+	suite.Equal(LintMatrix{{"values.yaml", "values-prod.yaml"}, {"values.yaml", "values-staging.yaml"}}, sets)
+
+	// how config_file passes a list of lists
+	suite.Require().NoError(sets.Decode(`["values.yaml,values-prod.yaml","values-dev.yaml"]`))
+	suite.Equal(LintMatrix{{"values.yaml", "values-prod.yaml"}, {"values-dev.yaml"}}, sets)
+
+	suite.Require().NoError(sets.Decode("values-prod.yaml, values-staging.yaml"))
+	suite.Equal(LintMatrix{{"values-prod.yaml"}, {"values-staging.yaml"}}, sets)
+
+	suite.EqualError(sets.Decode(`[["values.yaml", 3]]`), "invalid lint_matrix entry [values.yaml 3]: must be a list of files")
+	suite.Error(sets.Decode(`[not json`))
+}
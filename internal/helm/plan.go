@@ -4,14 +4,16 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/mongodb-forks/drone-helm3/internal/env"
 	"github.com/mongodb-forks/drone-helm3/internal/run"
 )
 
 const (
-	kubeConfigTemplate = "/root/.kube/config.tpl"
-	kubeConfigFile     = "/root/.kube/config"
+	// defaultKubeConfigTemplate is where the docker image puts assets/kubeconfig.tpl
+	defaultKubeConfigTemplate = "/etc/drone-helm3/kubeconfig.tpl"
 )
 
 // A Step is one step in the plan.
@@ -20,6 +22,17 @@ type Step interface {
 	Execute() error
 }
 
+// A cleaner is a Step that leaves temporary files behind, which should be removed once the plan is done with them.
+type cleaner interface {
+	Cleanup() error
+}
+
+// A reverter is a Step that makes changes which should be undone if a later step fails, e.g. a v2-to-v3 conversion
+// that's followed by a failed upgrade.
+type reverter interface {
+	Revert() error
+}
+
 // A Plan is a series of steps to perform.
 type Plan struct {
 	steps []Step
@@ -36,6 +49,7 @@ func NewPlan(cfg env.Config) (*Plan, error) {
 		return nil, errors.New("update_dependencies is deprecated and cannot be provided together with dependencies_action")
 	}
 
+	cfg = withKubeConfigPaths(cfg)
 	p.steps = (*determineSteps(cfg))(cfg)
 
 	for i, step := range p.steps {
@@ -45,6 +59,7 @@ func NewPlan(cfg env.Config) (*Plan, error) {
 
 		if err := step.Prepare(); err != nil {
 			err = fmt.Errorf("while preparing %T step: %w", step, err)
+			p.cleanup()
 			return nil, err
 		}
 	}
@@ -55,37 +70,89 @@ func NewPlan(cfg env.Config) (*Plan, error) {
 // determineSteps is primarily for the tests' convenience: it allows testing the "which stuff should
 // we do" logic without building a config that meets all the steps' requirements.
 func determineSteps(cfg env.Config) *func(env.Config) []Step {
-	switch cfg.Command {
+	switch cfg.Mode() {
 	case "upgrade":
 		return &upgrade
-	case "uninstall", "delete":
+	case "uninstall":
 		return &uninstall
 	case "lint":
 		return &lint
 	case "convert":
 		return &convert
-	case "help":
-		return &help
+	case "v2-cleanup":
+		return &v2Cleanup
+	case "preview":
+		return &preview
+	case "preview_cleanup":
+		return &previewCleanup
+	case "promote":
+		return &promote
+	case "skip":
+		return &skip
 	default:
-		switch cfg.DroneEvent {
-		case "push", "tag", "deployment", "pull_request", "promote", "rollback":
-			return &upgrade
-		case "delete":
-			return &uninstall
-		default:
-			return &help
+		return &help
+	}
+}
+
+// withKubeConfigPaths fills in the kubeconfig template and file locations when they aren't configured. Defaults are
+// under $HOME when it's writable, so the plugin doesn't need to run as root. With skip_kubeconfig, no file is written,
+// so the path is left empty unless it's configured, and helm finds the cluster the way it usually would.
+func withKubeConfigPaths(cfg env.Config) env.Config {
+	home, homeErr := os.UserHomeDir()
+
+	if cfg.KubeConfigTemplate == "" {
+		cfg.KubeConfigTemplate = defaultKubeConfigTemplate
+		if homeErr == nil {
+			if homeTemplate := filepath.Join(home, ".kube", "config.tpl"); fileExists(homeTemplate) {
+				cfg.KubeConfigTemplate = homeTemplate
+			}
 		}
 	}
+
+	if cfg.KubeConfigPath == "" && !cfg.SkipKubeconfig {
+		kubeDir := filepath.Join(os.TempDir(), ".kube")
+		if homeErr == nil && writableDir(filepath.Join(home, ".kube")) {
+			kubeDir = filepath.Join(home, ".kube")
+		}
+		cfg.KubeConfigPath = filepath.Join(kubeDir, "config")
+	}
+
+	return cfg
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// writableDir reports whether files can be created in the directory, or, if it doesn't exist yet, whether it can be
+// created in its parent. The InitKube step creates it when it writes the kubeconfig.
+func writableDir(dir string) bool {
+	if info, err := os.Stat(dir); os.IsNotExist(err) {
+		dir = filepath.Dir(dir)
+	} else if err != nil || !info.IsDir() {
+		return false
+	}
+	probe, err := os.CreateTemp(dir, ".drone-helm3-*")
+	if err != nil {
+		return false
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return true
 }
 
 // Execute runs each step in the plan, aborting and reporting on error
 func (p *Plan) Execute() error {
+	defer p.cleanup()
+
 	for i, step := range p.steps {
 		if p.cfg.Debug {
 			fmt.Fprintf(p.cfg.Stderr, "calling %T.Execute (step %d)\n", step, i)
 		}
 
 		if err := step.Execute(); err != nil {
+			p.revert(p.steps[:i])
 			return fmt.Errorf("while executing %T step: %w", step, err)
 		}
 	}
@@ -93,15 +160,28 @@ func (p *Plan) Execute() error {
 	return nil
 }
 
+// revert undoes the changes of steps that ran before a failed step, latest first. Failures are reported but don't
+// stop the other steps from being reverted.
+func (p *Plan) revert(steps []Step) {
+	for i := len(steps) - 1; i >= 0; i-- {
+		r, ok := steps[i].(reverter)
+		if !ok {
+			continue
+		}
+		if err := r.Revert(); err != nil && p.cfg.Stderr != nil {
+			fmt.Fprintf(p.cfg.Stderr, "Warning: while reverting %T step: %s\n", steps[i], err)
+		}
+	}
+}
+
 var upgrade = func(cfg env.Config) []Step {
 	var steps []Step
 	if !cfg.SkipKubeconfig {
-		steps = append(steps, run.NewInitKube(cfg, kubeConfigTemplate, kubeConfigFile))
+		steps = append(steps, run.NewInitKube(cfg, cfg.KubeConfigTemplate, cfg.KubeConfigPath))
 	}
 
-	if !cfg.DisableV2Conversion {
-		// The "helm" context is coming from the template
-		steps = append(steps, run.NewConvert(cfg, kubeConfigFile, "helm"))
+	if !cfg.Preflight {
+		steps = appendConvert(steps, cfg)
 	}
 
 	for _, repo := range cfg.AddRepos {
@@ -116,15 +196,76 @@ var upgrade = func(cfg env.Config) []Step {
 		steps = append(steps, run.NewDepUpdate(cfg))
 	}
 
+	// the preflight check renders the chart, so its repos and dependencies have to be in place, but nothing in the
+	// cluster should change until it passes, so the conversion waits for it
+	if cfg.Preflight {
+		steps = append(steps, run.NewPreflight(cfg, cfg.KubeConfigPath))
+		steps = appendConvert(steps, cfg)
+	}
+
 	steps = append(steps, run.NewUpgrade(cfg))
 
 	return steps
 }
 
+// appendConvert adds the step that converts the release from helm v2, unless the conversion is disabled.
+func appendConvert(steps []Step, cfg env.Config) []Step {
+	if cfg.DisableV2Conversion {
+		return steps
+	}
+	// an upgrade only converts its own release, even if convert_all is set
+	convertCfg := cfg
+	convertCfg.ConvertAll = false
+	return append(steps, run.NewConvert(convertCfg, cfg.KubeConfigPath, kubeContext(cfg)))
+}
+
+// kubeContext is the context the conversion steps use: the "helm" context from the kubeconfig template, or with
+// skip_kubeconfig, the current context of the kubeconfig helm finds.
+func kubeContext(cfg env.Config) string {
+	if cfg.SkipKubeconfig {
+		return ""
+	}
+	return "helm"
+}
+
+// preview is an upgrade into a pull request's own release and namespace, which are prepared by the Preview step.
+var preview = func(cfg env.Config) []Step {
+	name := run.PreviewName(cfg)
+	cfg.Release, cfg.Namespace = name, name
+
+	steps := upgrade(cfg)
+	// the namespace has to exist before anything runs in it, but the Preview step needs the kubeconfig
+	split := 0
+	if !cfg.SkipKubeconfig {
+		split = 1
+	}
+	return append(steps[:split:split], append([]Step{run.NewPreview(cfg, cfg.KubeConfigPath)}, steps[split:]...)...)
+}
+
+var previewCleanup = func(cfg env.Config) []Step {
+	var steps []Step
+	if !cfg.SkipKubeconfig {
+		steps = append(steps, run.NewInitKube(cfg, cfg.KubeConfigTemplate, cfg.KubeConfigPath))
+	}
+	steps = append(steps, run.NewPreviewCleanup(cfg, cfg.KubeConfigPath))
+
+	return steps
+}
+
+var promote = func(cfg env.Config) []Step {
+	var steps []Step
+	if !cfg.SkipKubeconfig {
+		steps = append(steps, run.NewInitKube(cfg, cfg.KubeConfigTemplate, cfg.KubeConfigPath))
+	}
+	steps = append(steps, run.NewPromote(cfg, cfg.KubeConfigPath))
+
+	return steps
+}
+
 var uninstall = func(cfg env.Config) []Step {
 	var steps []Step
 	if !cfg.SkipKubeconfig {
-		steps = append(steps, run.NewInitKube(cfg, kubeConfigTemplate, kubeConfigFile))
+		steps = append(steps, run.NewInitKube(cfg, cfg.KubeConfigTemplate, cfg.KubeConfigPath))
 	}
 	if cfg.UpdateDependencies {
 		steps = append(steps, run.NewDepUpdate(cfg))
@@ -140,22 +281,70 @@ var lint = func(cfg env.Config) []Step {
 		steps = append(steps, run.NewAddRepo(cfg, repo))
 	}
 	if cfg.UpdateDependencies {
-		steps = append(steps, run.NewDepUpdate(cfg))
+		for _, chart := range lintDependencyCharts(cfg.Chart) {
+			depCfg := cfg
+			depCfg.Chart = chart
+			steps = append(steps, run.NewDepUpdate(depCfg))
+		}
 	}
 	steps = append(steps, run.NewLint(cfg))
 	return steps
 }
 
+// lintDependencyCharts lists the charts whose dependencies lint mode updates. Packaged charts already contain theirs.
+// If the chart setting can't be expanded, it's used as it is, and the Lint step reports the problem.
+func lintDependencyCharts(chart string) []string {
+	charts, err := run.LintCharts(chart)
+	if err != nil || len(charts) == 0 {
+		return []string{chart}
+	}
+
+	var unpackaged []string
+	for _, chart := range charts {
+		if !strings.HasSuffix(chart, ".tgz") {
+			unpackaged = append(unpackaged, chart)
+		}
+	}
+	return unpackaged
+}
+
 var help = func(cfg env.Config) []Step {
 	return []Step{run.NewHelp(cfg)}
 }
 
+var skip = func(cfg env.Config) []Step {
+	return []Step{run.NewSkip(cfg)}
+}
+
 var convert = func(cfg env.Config) []Step {
 	var steps []Step
-	steps = append(steps, run.NewInitKube(cfg, kubeConfigTemplate, kubeConfigFile))
+	if !cfg.SkipKubeconfig {
+		steps = append(steps, run.NewInitKube(cfg, cfg.KubeConfigTemplate, cfg.KubeConfigPath))
+	}
+	steps = append(steps, run.NewConvert(cfg, cfg.KubeConfigPath, kubeContext(cfg)))
 
-	// The "helm" context is coming from the template
-	steps = append(steps, run.NewConvert(cfg, kubeConfigFile, "helm"))
+	return steps
+}
+
+var v2Cleanup = func(cfg env.Config) []Step {
+	var steps []Step
+	if !cfg.SkipKubeconfig {
+		steps = append(steps, run.NewInitKube(cfg, cfg.KubeConfigTemplate, cfg.KubeConfigPath))
+	}
+	steps = append(steps, run.NewV2Cleanup(cfg, cfg.KubeConfigPath, kubeContext(cfg)))
 
 	return steps
 }
+
+// cleanup gives every step a chance to remove its temporary files. Failures are reported but don't fail the plan.
+func (p *Plan) cleanup() {
+	for _, step := range p.steps {
+		c, ok := step.(cleaner)
+		if !ok {
+			continue
+		}
+		if err := c.Cleanup(); err != nil && p.cfg.Stderr != nil {
+			fmt.Fprintf(p.cfg.Stderr, "Warning: while cleaning up after %T step: %s\n", step, err)
+		}
+	}
+}
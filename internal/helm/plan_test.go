@@ -2,6 +2,8 @@ package helm
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -116,6 +118,158 @@ func (suite *PlanTestSuite) TestExecuteAbortsOnError() {
 	suite.EqualError(err, "while executing *helm.MockStep step: oh, he'll gnaw")
 }
 
+func (suite *PlanTestSuite) TestKubeConfigPathsDefaultToHome() {
+	home := suite.T().TempDir()
+	suite.T().Setenv("HOME", home)
+
+	cfg := withKubeConfigPaths(env.Config{})
+	suite.Equal(defaultKubeConfigTemplate, cfg.KubeConfigTemplate)
+	suite.Equal(filepath.Join(home, ".kube", "config"), cfg.KubeConfigPath)
+	suite.NoDirExists(filepath.Join(home, ".kube"), "the directory should be left to the InitKube step")
+
+	// a template in the home directory takes precedence over the one in the docker image
+	homeTemplate := filepath.Join(home, ".kube", "config.tpl")
+	suite.Require().NoError(os.Mkdir(filepath.Dir(homeTemplate), 0700))
+	suite.Require().NoError(os.WriteFile(homeTemplate, []byte("apiVersion: v1"), 0600))
+	cfg = withKubeConfigPaths(env.Config{})
+	suite.Equal(homeTemplate, cfg.KubeConfigTemplate)
+}
+
+func (suite *PlanTestSuite) TestKubeConfigPathsWithUnwritableHome() {
+	suite.T().Setenv("HOME", "/proc/drone-helm3")
+
+	cfg := withKubeConfigPaths(env.Config{})
+	suite.Equal(filepath.Join(os.TempDir(), ".kube", "config"), cfg.KubeConfigPath)
+}
+
+func (suite *PlanTestSuite) TestKubeConfigPathsWithSkipKubeconfig() {
+	suite.T().Setenv("HOME", suite.T().TempDir())
+
+	cfg := withKubeConfigPaths(env.Config{SkipKubeconfig: true})
+	suite.Empty(cfg.KubeConfigPath, "helm should find the cluster the way it usually does")
+
+	cfg = withKubeConfigPaths(env.Config{SkipKubeconfig: true, KubeConfigPath: "/workspace/kubeconfig"})
+	suite.Equal("/workspace/kubeconfig", cfg.KubeConfigPath)
+}
+
+func (suite *PlanTestSuite) TestKubeConfigPathsFromConfig() {
+	cfg := withKubeConfigPaths(env.Config{
+		KubeConfigTemplate: "/workspace/kubeconfig.tpl",
+		KubeConfigPath:     "/workspace/kubeconfig",
+	})
+	suite.Equal("/workspace/kubeconfig.tpl", cfg.KubeConfigTemplate)
+	suite.Equal("/workspace/kubeconfig", cfg.KubeConfigPath)
+}
+
+// cleanupStep is a Step that also implements the cleaner interface.
+type cleanupStep struct {
+	*MockStep
+	cleanups int
+}
+
+func (c *cleanupStep) Cleanup() error {
+	c.cleanups++
+	return nil
+}
+
+func (suite *PlanTestSuite) TestExecuteCleansUp() {
+	ctrl := gomock.NewController(suite.T())
+	defer ctrl.Finish()
+	stepOne := &cleanupStep{MockStep: NewMockStep(ctrl)}
+	stepTwo := NewMockStep(ctrl)
+
+	plan := Plan{
+		steps: []Step{stepOne, stepTwo},
+	}
+
+	stepOne.EXPECT().
+		Execute().
+		Times(1)
+	stepTwo.EXPECT().
+		Execute().
+		Return(fmt.Errorf("the tide is high"))
+
+	suite.Error(plan.Execute())
+	suite.Equal(1, stepOne.cleanups, "steps should be cleaned up even when the plan fails")
+}
+
+// revertStep is a Step that also implements the reverter interface.
+type revertStep struct {
+	*MockStep
+	reverts int
+	err     error
+}
+
+func (r *revertStep) Revert() error {
+	r.reverts++
+	return r.err
+}
+
+func (suite *PlanTestSuite) TestExecuteRevertsEarlierStepsOnError() {
+	ctrl := gomock.NewController(suite.T())
+	defer ctrl.Finish()
+	stepOne := &revertStep{MockStep: NewMockStep(ctrl), err: fmt.Errorf("a tidal wave")}
+	stepTwo := &revertStep{MockStep: NewMockStep(ctrl)}
+	stepThree := &revertStep{MockStep: NewMockStep(ctrl)}
+	stderr := &strings.Builder{}
+
+	plan := Plan{
+		steps: []Step{stepOne, stepTwo, stepThree},
+		cfg:   env.Config{Stderr: stderr},
+	}
+
+	stepOne.EXPECT().
+		Execute()
+	stepTwo.EXPECT().
+		Execute().
+		Return(fmt.Errorf("the tide is high"))
+
+	suite.Error(plan.Execute())
+	suite.Equal(1, stepOne.reverts, "steps before the failed one should be reverted")
+	suite.Equal(0, stepTwo.reverts, "the failed step shouldn't be reverted")
+	suite.Equal(0, stepThree.reverts, "steps that didn't run shouldn't be reverted")
+	suite.Equal("Warning: while reverting *helm.revertStep step: a tidal wave\n", stderr.String())
+}
+
+func (suite *PlanTestSuite) TestExecuteDoesNotRevertOnSuccess() {
+	ctrl := gomock.NewController(suite.T())
+	defer ctrl.Finish()
+	stepOne := &revertStep{MockStep: NewMockStep(ctrl)}
+
+	plan := Plan{
+		steps: []Step{stepOne},
+	}
+
+	stepOne.EXPECT().
+		Execute()
+
+	suite.NoError(plan.Execute())
+	suite.Equal(0, stepOne.reverts)
+}
+
+func (suite *PlanTestSuite) TestNewPlanCleansUpOnError() {
+	ctrl := gomock.NewController(suite.T())
+	defer ctrl.Finish()
+	stepOne := &cleanupStep{MockStep: NewMockStep(ctrl)}
+	stepTwo := NewMockStep(ctrl)
+
+	origHelp := help
+	help = func(cfg env.Config) []Step {
+		return []Step{stepOne, stepTwo}
+	}
+	defer func() { help = origHelp }()
+
+	stepOne.EXPECT().
+		Prepare()
+	stepTwo.EXPECT().
+		Prepare().
+		Return(fmt.Errorf("but I'm holding on"))
+
+	_, err := NewPlan(env.Config{Command: "help"})
+	suite.Error(err)
+	suite.Equal(1, stepOne.cleanups)
+}
+
 func (suite *PlanTestSuite) TestUpgrade() {
 	steps := upgrade(env.Config{})
 	suite.Require().Equal(3, len(steps), "upgrade should return 3 steps")
@@ -153,6 +307,30 @@ func (suite *PlanTestSuite) TestUpgradeWithAddRepos() {
 	suite.IsType(&run.AddRepo{}, steps[2])
 }
 
+func (suite *PlanTestSuite) TestUpgradeWithPreflight() {
+	steps := upgrade(env.Config{Preflight: true})
+	suite.Require().Equal(4, len(steps), "upgrade should have a preflight step when Preflight is true")
+	suite.IsType(&run.InitKube{}, steps[0])
+	suite.IsType(&run.Preflight{}, steps[1])
+	suite.IsType(&run.Convert{}, steps[2])
+	suite.IsType(&run.Upgrade{}, steps[3])
+}
+
+func (suite *PlanTestSuite) TestUpgradeWithPreflightAfterDependencies() {
+	steps := upgrade(env.Config{
+		Preflight:          true,
+		AddRepos:           []string{"machine=https://github.com/harold_finch/themachine"},
+		DependenciesAction: "build",
+	})
+	suite.Require().Equal(6, len(steps))
+	suite.IsType(&run.InitKube{}, steps[0])
+	suite.IsType(&run.AddRepo{}, steps[1])
+	suite.IsType(&run.DepAction{}, steps[2])
+	suite.IsType(&run.Preflight{}, steps[3], "preflight renders the chart, so its repos and dependencies come first")
+	suite.IsType(&run.Convert{}, steps[4])
+	suite.IsType(&run.Upgrade{}, steps[5])
+}
+
 func (suite *PlanTestSuite) TestUpgradeWithoutConvert() {
 
 	steps := upgrade(env.Config{DisableV2Conversion: true})
@@ -194,6 +372,21 @@ func (suite *PlanTestSuite) TestLintWithUpdateDependencies() {
 	suite.IsType(&run.DepUpdate{}, steps[0])
 }
 
+func (suite *PlanTestSuite) TestLintUpdatesDependenciesPerChart() {
+	dir := suite.T().TempDir()
+	for _, chart := range []string{"api", "web"} {
+		suite.Require().NoError(os.MkdirAll(filepath.Join(dir, chart), 0755))
+		suite.Require().NoError(os.WriteFile(filepath.Join(dir, chart, "Chart.yaml"), []byte("name: "+chart), 0644))
+	}
+	suite.Require().NoError(os.WriteFile(filepath.Join(dir, "worker-1.0.0.tgz"), nil, 0644))
+
+	steps := lint(env.Config{UpdateDependencies: true, Chart: filepath.Join(dir, "*")})
+	suite.Require().Equal(3, len(steps), "packaged charts already contain their dependencies")
+	suite.IsType(&run.DepUpdate{}, steps[0])
+	suite.IsType(&run.DepUpdate{}, steps[1])
+	suite.IsType(&run.Lint{}, steps[2])
+}
+
 func (suite *PlanTestSuite) TestLintWithAddRepos() {
 	cfg := env.Config{
 		AddRepos: []string{"friendczar=https://github.com/logan_pierce/friendczar"},
@@ -280,3 +473,88 @@ func (suite *PlanTestSuite) TestDeterminePlanConvertCommand() {
 	stepsMaker := determineSteps(cfg)
 	suite.Same(&convert, stepsMaker)
 }
+
+func (suite *PlanTestSuite) TestV2Cleanup() {
+	steps := v2Cleanup(env.Config{})
+	suite.Require().Equal(2, len(steps))
+	suite.IsType(&run.InitKube{}, steps[0])
+	suite.IsType(&run.V2Cleanup{}, steps[1])
+
+	suite.Same(&v2Cleanup, determineSteps(env.Config{Command: "v2-cleanup"}))
+}
+
+func (suite *PlanTestSuite) TestConvertWithSkipKubeconfig() {
+	plan, err := NewPlan(env.Config{Command: "convert", Release: "myapp", SkipKubeconfig: true})
+	suite.Require().NoError(err, "there's no kubeconfig file to write")
+	suite.Require().Equal(1, len(plan.steps))
+	suite.IsType(&run.Convert{}, plan.steps[0])
+}
+
+func (suite *PlanTestSuite) TestV2CleanupWithSkipKubeconfig() {
+	plan, err := NewPlan(env.Config{Command: "v2-cleanup", V2Retention: "720h", SkipKubeconfig: true})
+	suite.Require().NoError(err, "there's no kubeconfig file to write")
+	suite.Require().Equal(1, len(plan.steps))
+	suite.IsType(&run.V2Cleanup{}, plan.steps[0])
+}
+
+func (suite *PlanTestSuite) TestPreview() {
+	steps := preview(env.Config{Repo: "octocat/Hello_World", PullRequest: "42", Release: "hello", Namespace: "production"})
+	suite.Require().Equal(4, len(steps), "preview should add a Preview step to the upgrade")
+	suite.IsType(&run.InitKube{}, steps[0])
+	suite.IsType(&run.Preview{}, steps[1])
+	suite.IsType(&run.Convert{}, steps[2])
+	suite.IsType(&run.Upgrade{}, steps[3])
+}
+
+func (suite *PlanTestSuite) TestPreviewWithSkipKubeconfig() {
+	steps := preview(env.Config{PullRequest: "42", SkipKubeconfig: true})
+	suite.Require().Equal(3, len(steps))
+	suite.IsType(&run.Preview{}, steps[0])
+	suite.IsType(&run.Upgrade{}, steps[2])
+}
+
+func (suite *PlanTestSuite) TestPreviewCleanup() {
+	steps := previewCleanup(env.Config{})
+	suite.Require().Equal(2, len(steps))
+	suite.IsType(&run.InitKube{}, steps[0])
+	suite.IsType(&run.PreviewCleanup{}, steps[1])
+}
+
+func (suite *PlanTestSuite) TestDeterminePlanPreviewCommands() {
+	suite.Same(&preview, determineSteps(env.Config{Command: "preview"}))
+	suite.Same(&previewCleanup, determineSteps(env.Config{Command: "preview_cleanup"}))
+}
+
+func (suite *PlanTestSuite) TestDeterminePlanFromEventModes() {
+	cfg := env.Config{
+		DroneEvent: "pull_request",
+		EventModes: env.EventModes{"pull_request": "lint", "cron": "preview_cleanup"},
+	}
+	suite.Same(&lint, determineSteps(cfg), "event_modes should override the built-in choice")
+
+	cfg.DroneEvent = "cron"
+	suite.Same(&previewCleanup, determineSteps(cfg))
+
+	cfg.Command = "upgrade"
+	suite.Same(&upgrade, determineSteps(cfg), "mode should override event_modes")
+}
+
+func (suite *PlanTestSuite) TestDeterminePlanUnmappedEvent() {
+	cfg := env.Config{DroneEvent: "custom"}
+	suite.Same(&help, determineSteps(cfg))
+
+	cfg.SkipUnmappedEvents = true
+	suite.Same(&skip, determineSteps(cfg))
+
+	cfg.Command = "iambic"
+	suite.Same(&help, determineSteps(cfg), "an unknown mode should still be an error")
+}
+
+func (suite *PlanTestSuite) TestPromote() {
+	steps := promote(env.Config{})
+	suite.Require().Equal(2, len(steps))
+	suite.IsType(&run.InitKube{}, steps[0])
+	suite.IsType(&run.Promote{}, steps[1])
+
+	suite.Same(&promote, determineSteps(env.Config{Command: "promote"}))
+}
@@ -6,18 +6,20 @@ import (
 )
 
 type config struct {
-	debug     bool
-	namespace string
-	stdout    io.Writer
-	stderr    io.Writer
+	debug      bool
+	namespace  string
+	kubeConfig string
+	stdout     io.Writer
+	stderr     io.Writer
 }
 
 func newConfig(cfg env.Config) *config {
 	return &config{
-		debug:     cfg.Debug,
-		namespace: cfg.Namespace,
-		stdout:    cfg.Stdout,
-		stderr:    cfg.Stderr,
+		debug:      cfg.Debug,
+		namespace:  cfg.Namespace,
+		kubeConfig: cfg.KubeConfigPath,
+		stdout:     cfg.Stdout,
+		stderr:     cfg.Stderr,
 	}
 }
 
@@ -29,5 +31,8 @@ func (cfg *config) globalFlags() []string {
 	if cfg.namespace != "" {
 		flags = append(flags, "--namespace", cfg.namespace)
 	}
+	if cfg.kubeConfig != "" {
+		flags = append(flags, "--kubeconfig", cfg.kubeConfig)
+	}
 	return flags
 }
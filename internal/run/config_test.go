@@ -19,28 +19,31 @@ func (suite *ConfigTestSuite) TestNewConfig() {
 	stdout := &strings.Builder{}
 	stderr := &strings.Builder{}
 	envCfg := env.Config{
-		Namespace: "private",
-		Debug:     true,
-		Stdout:    stdout,
-		Stderr:    stderr,
+		Namespace:      "private",
+		KubeConfigPath: "/home/drone/.kube/config",
+		Debug:          true,
+		Stdout:         stdout,
+		Stderr:         stderr,
 	}
 	cfg := newConfig(envCfg)
 	suite.Require().NotNil(cfg)
 	suite.Equal(&config{
-		namespace: "private",
-		debug:     true,
-		stdout:    stdout,
-		stderr:    stderr,
+		namespace:  "private",
+		kubeConfig: "/home/drone/.kube/config",
+		debug:      true,
+		stdout:     stdout,
+		stderr:     stderr,
 	}, cfg)
 }
 
 func (suite *ConfigTestSuite) TestGlobalFlags() {
 	cfg := config{
-		debug:     true,
-		namespace: "public",
+		debug:      true,
+		namespace:  "public",
+		kubeConfig: "/home/drone/.kube/config",
 	}
 	flags := cfg.globalFlags()
-	suite.Equal([]string{"--debug", "--namespace", "public"}, flags)
+	suite.Equal([]string{"--debug", "--namespace", "public", "--kubeconfig", "/home/drone/.kube/config"}, flags)
 
 	cfg = config{}
 	flags = cfg.globalFlags()
@@ -1,8 +1,13 @@
 package run
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"path"
+	"strings"
+	"time"
 	ctx "context"
 
 	convertcmd "github.com/helm/helm-2to3/cmd"
@@ -11,36 +16,150 @@ import (
 	"github.com/pkg/errors"
 	"helm.sh/helm/v3/pkg/action"
 	"helm.sh/helm/v3/pkg/cli"
-	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 )
 
-func v3ReleaseFound(release string, cfg *action.Configuration) bool {
+// Tiller's storage backends, as named by the tiller_storage setting
+const (
+	configmapStorage = "configmap"
+	secretStorage    = "secret"
+)
+
+const (
+	// ownerLabel is the label Tiller finds its releases by
+	ownerLabel = "OWNER"
+	// defaultPreserveLabel keeps converted v2 releases out of Tiller's sight, unless v2_preserve_label says otherwise
+	defaultPreserveLabel = "OWNER=converted-to-helm3"
+	// convertedAtAnnotation records when a v2 release version was preserved, for v2-cleanup's retention period
+	convertedAtAnnotation = "drone-helm3/converted-at"
+	// convertedByAnnotation records the Drone build that preserved a v2 release version
+	convertedByAnnotation = "drone-helm3/converted-by"
+)
+
+// What conversion does with a release that has both v2 and v3 records, as named by the convert_conflict_policy setting
+const (
+	conflictSkip      = "skip"
+	conflictFail      = "fail"
+	conflictOverwrite = "overwrite"
+)
+
+// actionsFor returns the helm action configuration for a namespace, in which it looks for v3 releases. The tests
+// replace it with one backed by memory.
+type actionsFor func(namespace string) (*action.Configuration, error)
+
+// actions returns action configurations for the cluster in the step's kubeconfig
+func (c *Convert) actions() actionsFor {
+	settings := cli.New()
+	settings.KubeConfig = c.kubeConfig
+	settings.KubeContext = c.kubeContext
+	return func(namespace string) (*action.Configuration, error) {
+		actionCfg := new(action.Configuration)
+		err := actionCfg.Init(settings.RESTClientGetter(), namespace, "secrets", c.debug)
+		return actionCfg, err
+	}
+}
+
+// v3ReleaseStatus looks for the release anywhere in its helm v3 history, so a release whose only revisions are failed
+// or pending still counts. It returns the status of the latest revision.
+func v3ReleaseStatus(name string, cfg *action.Configuration) (string, bool) {
+
+	history, err := cfg.Releases.History(name)
+	if err != nil || len(history) == 0 {
+		log.Printf("No v3 Release of %s found", name)
+		return "", false
+	}
+
+	latest := history[0]
+	for _, revision := range history[1:] {
+		if revision.Version > latest.Version {
+			latest = revision
+		}
+	}
+	status := "unknown"
+	if latest.Info != nil {
+		status = latest.Info.Status.String()
+	}
+	log.Printf("A v3 Release of %s was found (status: %s)", name, status)
+	return status, true
+}
+
+// v3ReleaseDeployed reports whether the release has a deployed helm v3 revision
+func v3ReleaseDeployed(release string, cfg *action.Configuration) bool {
 
 	if _, err := cfg.Releases.Deployed(release); err == nil {
-		log.Printf("A v3 Release of %s was found", release)
+		log.Printf("A deployed v3 Release of %s was found", release)
 		return true
 	}
 
-	log.Printf("No v3 Release of %s found", release)
+	log.Printf("No deployed v3 Release of %s found", release)
 	return false
 }
 
-// clientsetFromFile returns a ready-to-use client from a kubeconfig file
-func clientsetFromFile(path string) (*kubernetes.Clientset, error) {
+// kubeCluster returns the cluster connection settings that take precedence over the ones in the kubeconfig file
+func kubeCluster(cfg env.Config) clientcmdapi.Cluster {
+	cluster := clientcmdapi.Cluster{
+		ProxyURL:      cfg.ProxyURL,
+		TLSServerName: cfg.TLSServerName,
+	}
+	if cfg.Certificate == "" && !cfg.SkipTLSVerify {
+		cluster.CertificateAuthority = cfg.CertificateFile
+	}
+	return cluster
+}
+
+// restConfigFromFile returns an API client configuration from a kubeconfig file. Without one, which is the case when
+// skip_kubeconfig is set, the configuration is found the way helm finds it: $KUBECONFIG, ~/.kube/config, or the
+// in-cluster service account.
+func restConfigFromFile(path string, cluster clientcmdapi.Cluster) (*rest.Config, error) {
+	overrides := clientcmd.ConfigOverrides{Timeout: "15s", ClusterInfo: cluster}
+	if path == "" {
+		clientConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(clientcmd.NewDefaultClientConfigLoadingRules(), &overrides).ClientConfig()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to find an API client configuration")
+		}
+		return clientConfig, nil
+	}
+
 	config, err := clientcmd.LoadFromFile(path)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to load admin kubeconfig")
 	}
 
-	overrides := clientcmd.ConfigOverrides{Timeout: "15s"}
 	clientConfig, err := clientcmd.NewDefaultClientConfig(*config, &overrides).ClientConfig()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create API client configuration from kubeconfig")
 	}
 
+	return clientConfig, nil
+}
+
+// namespaceFromFile returns the namespace helm uses when there's no namespace setting: the one in the kubeconfig's
+// current context, or "default". Without a kubeconfig file, the configuration is found the way restConfigFromFile
+// finds it.
+func namespaceFromFile(path string) string {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = path
+	namespace, _, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{}).Namespace()
+	if err != nil || namespace == "" {
+		return metav1.NamespaceDefault
+	}
+	return namespace
+}
+
+// clientsetFromFile returns a ready-to-use client from a kubeconfig file
+func clientsetFromFile(path string, cluster clientcmdapi.Cluster) (*kubernetes.Clientset, error) {
+	clientConfig, err := restConfigFromFile(path, cluster)
+	if err != nil {
+		return nil, err
+	}
+
 	return kubernetes.NewForConfig(clientConfig)
 }
 
@@ -60,6 +179,24 @@ type Convert struct {
 	debug             action.DebugLog
 	kubeConfig        string
 	kubeContext       string
+	cluster           clientcmdapi.Cluster
+	storage           string
+	releasePath       string
+	conflictPolicy    string
+	preserveLabel     string
+	preserveKey       string
+	preserveValue     string
+	build             string
+	tillerLabel       string
+	all               bool
+	include           []string
+	exclude           []string
+	reportFile        string
+	reportEmpty       bool
+	plans             []conversionPlan
+	changes           []conversionChange
+	clientset         kubernetes.Interface
+	stdout            io.Writer
 	convertOptions    convertcmd.ConvertOptions
 	convertReleaseCmd ConvertCmd
 }
@@ -71,6 +208,17 @@ func NewConvert(cfg env.Config, kubeConfig string, kubeContext string) *Convert
 		namespace:         cfg.Namespace,
 		kubeConfig:        kubeConfig,
 		kubeContext:       kubeContext,
+		cluster:           kubeCluster(cfg),
+		storage:           cfg.TillerStorage,
+		releasePath:       cfg.V2ReleasePath,
+		conflictPolicy:    cfg.ConvertConflictPolicy,
+		preserveLabel:     cfg.V2PreserveLabel,
+		all:               cfg.ConvertAll,
+		include:           cfg.ConvertInclude,
+		exclude:           cfg.ConvertExclude,
+		reportFile:        cfg.ConvertReportFile,
+		reportEmpty:       cfg.Mode() == "convert",
+		stdout:            cfg.Stdout,
 		convertReleaseCmd: &ConvertRelease{},
 	}
 
@@ -86,19 +234,41 @@ func NewConvert(cfg env.Config, kubeConfig string, kubeContext string) *Convert
 		cfg.TillerLabel = "OWNER=TILLER"
 	}
 
-	// Build the label selector "OWNER=TILLER,NAME=myapp"
-	cfg.TillerLabel += fmt.Sprintf(",NAME=%s", cfg.Release)
+	if convert.storage == "" {
+		convert.storage = configmapStorage
+	}
+
+	if convert.conflictPolicy == "" {
+		convert.conflictPolicy = conflictSkip
+	}
+
+	if convert.preserveLabel == "" {
+		convert.preserveLabel = defaultPreserveLabel
+	}
+	// a label without a value is rejected in Prepare
+	if split := strings.SplitN(convert.preserveLabel, "=", 2); len(split) == 2 {
+		convert.preserveKey, convert.preserveValue = split[0], split[1]
+	}
+
+	if cfg.BuildNumber != "" {
+		build := buildInfo{commit: cfg.Commit, buildNumber: cfg.BuildNumber, repo: cfg.Repo, branch: cfg.Branch, tag: cfg.Tag}
+		convert.build = build.description()
+	}
 
+	convert.tillerLabel = cfg.TillerLabel
 	convert.convertOptions = convertcmd.ConvertOptions{
 		DeleteRelease:      cfg.DeleteV2Releases,
 		DryRun:             cfg.DryRun,
 		MaxReleaseVersions: cfg.MaxReleaseVersions,
-		ReleaseName:        cfg.Release,
-		StorageType:        "configmap",
-		TillerLabel:        cfg.TillerLabel,
+		StorageType:        convert.storage + "s", // 2to3 calls them configmaps and secrets
 		TillerNamespace:    cfg.TillerNS,
-		TillerOutCluster:   false,
+		TillerOutCluster:   cfg.TillerOutCluster,
 	}
+	if convert.storage == localStorage {
+		// local releases aren't in the cluster for 2to3 to find
+		convert.convertReleaseCmd = &localConvertRelease{path: convert.releasePath}
+	}
+	convert.forRelease(cfg.Release)
 
 	if cfg.Debug {
 		convert.debug = func(format string, v ...interface{}) {
@@ -110,39 +280,164 @@ func NewConvert(cfg env.Config, kubeConfig string, kubeContext string) *Convert
 	return convert
 }
 
-// getV2ReleaseConfigmaps returns a list of configmaps that are helm v2 releases
-func (c *Convert) getV2ReleaseConfigmaps(clientset kubernetes.Interface) (*corev1.ConfigMapList, error) {
+// forRelease points the conversion at the named release
+func (c *Convert) forRelease(release string) {
+	c.convertOptions.ReleaseName = release
+	// Build the label selector "OWNER=TILLER,NAME=myapp"
+	c.convertOptions.TillerLabel = fmt.Sprintf("%s,NAME=%s", c.tillerLabel, release)
+}
 
-	return clientset.CoreV1().ConfigMaps(c.convertOptions.TillerNamespace).List(ctx.Background(), metav1.ListOptions{
-		LabelSelector: c.convertOptions.TillerLabel,
-	})
+// getV2Releases returns the metadata of the configmaps or secrets in which Tiller stored the release's versions
+func (c *Convert) getV2Releases(clientset kubernetes.Interface) ([]metav1.ObjectMeta, error) {
+
+	return c.listV2Releases(clientset, c.convertOptions.TillerLabel)
 }
 
-// preserveV2ReleaseConfigmaps keeps the helm v2 configmaps by modifying a label
-func (c *Convert) preserveV2ReleaseConfigmaps(clientset kubernetes.Interface, configmaps *corev1.ConfigMapList, ownerLabelValue string) error {
+// listV2Releases returns the metadata of Tiller's configmaps or secrets that match the label selector
+func (c *Convert) listV2Releases(clientset kubernetes.Interface, selector string) ([]metav1.ObjectMeta, error) {
 
+	if c.storage == localStorage {
+		return c.listLocalReleases(selector)
+	}
+
+	opts := metav1.ListOptions{LabelSelector: selector}
 	tillerNamespace := c.convertOptions.TillerNamespace
 
-	log.Printf("Preserving release versions of %s", c.convertOptions.ReleaseName)
+	var versions []metav1.ObjectMeta
+	if c.storage == secretStorage {
+		secrets, err := clientset.CoreV1().Secrets(tillerNamespace).List(ctx.Background(), opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range secrets.Items {
+			versions = append(versions, item.ObjectMeta)
+		}
+		return versions, nil
+	}
+
+	configmaps, err := clientset.CoreV1().ConfigMaps(tillerNamespace).List(ctx.Background(), opts)
+	if err != nil {
+		return nil, err
+	}
 	for _, item := range configmaps.Items {
-		item.Labels["OWNER"] = ownerLabelValue
+		versions = append(versions, item.ObjectMeta)
+	}
+	return versions, nil
+}
 
-		if _, err := clientset.CoreV1().ConfigMaps(tillerNamespace).Update(ctx.Background(), &item, metav1.UpdateOptions{}); err != nil {
-			return fmt.Errorf("Failure preserving release version %s", item.Name)
+// preserveV2Releases keeps the helm v2 configmaps or secrets by marking them with v2_preserve_label, and annotating
+// them with the time and the Drone build. Only the metadata is patched, so the stored releases are left as they are.
+// If any version can't be marked, the ones already marked are restored, so the release is either preserved as a
+// whole or not at all.
+func (c *Convert) preserveV2Releases(clientset kubernetes.Interface, versions []metav1.ObjectMeta) error {
+
+	labels := map[string]interface{}{c.preserveKey: c.preserveValue}
+	if c.preserveKey != ownerLabel {
+		// without its OWNER label, Tiller no longer sees the version
+		labels[ownerLabel] = nil
+	}
+	annotations := map[string]interface{}{convertedAtAnnotation: time.Now().UTC().Format(time.RFC3339)}
+	if c.build != "" {
+		annotations[convertedByAnnotation] = c.build
+	}
+	patch, err := metadataPatch(labels, annotations)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Preserving release versions of %s", c.convertOptions.ReleaseName)
+	for i, item := range versions {
+		if err := c.patchV2Version(clientset, item.Name, patch); err != nil {
+			if restoreErr := c.restoreV2Versions(clientset, versions[:i]); restoreErr != nil {
+				return fmt.Errorf("Failure preserving release version %s: %v (%v)", item.Name, err, restoreErr)
+			}
+			return fmt.Errorf("Failure preserving release version %s: %w", item.Name, err)
 		}
 	}
 
 	return nil
 }
 
-func (c *Convert) doConvert(configmaps *corev1.ConfigMapList, clientset kubernetes.Interface, kc common.KubeConfig) error {
-	if len(configmaps.Items) > 0 {
+// restoreV2Versions puts back the labels and annotations that preserveV2Releases changed, using the versions'
+// metadata from before they were preserved
+func (c *Convert) restoreV2Versions(clientset kubernetes.Interface, versions []metav1.ObjectMeta) error {
+	for _, version := range versions {
+		labels := map[string]interface{}{ownerLabel: nil, c.preserveKey: nil}
+		for key := range labels {
+			if value, ok := version.Labels[key]; ok {
+				labels[key] = value
+			}
+		}
+		annotations := map[string]interface{}{convertedAtAnnotation: nil, convertedByAnnotation: nil}
+		for key := range annotations {
+			if value, ok := version.Annotations[key]; ok {
+				annotations[key] = value
+			}
+		}
+
+		patch, err := metadataPatch(labels, annotations)
+		if err == nil {
+			err = c.patchV2Version(clientset, version.Name, patch)
+		}
+		if err != nil {
+			return fmt.Errorf("could not restore v2 release version %s: %w", version.Name, err)
+		}
+	}
+	return nil
+}
+
+// metadataPatch returns a merge patch that sets the labels and annotations, removing those whose value is nil
+func metadataPatch(labels, annotations map[string]interface{}) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": labels, "annotations": annotations},
+	})
+}
+
+// patchV2Version applies a merge patch to one of the configmaps or secrets in which Tiller stored a release
+func (c *Convert) patchV2Version(clientset kubernetes.Interface, name string, patch []byte) error {
+	tillerNamespace := c.convertOptions.TillerNamespace
+	var err error
+	if c.storage == secretStorage {
+		_, err = clientset.CoreV1().Secrets(tillerNamespace).Patch(ctx.Background(), name, types.MergePatchType, patch, metav1.PatchOptions{})
+	} else {
+		_, err = clientset.CoreV1().ConfigMaps(tillerNamespace).Patch(ctx.Background(), name, types.MergePatchType, patch, metav1.PatchOptions{})
+	}
+	return err
+}
+
+// doConvert converts the release's v2 versions. With overwrite, the release's v3 records are removed first, after
+// they've been recorded so a revert can put them back.
+func (c *Convert) doConvert(versions []metav1.ObjectMeta, clientset kubernetes.Interface, kc common.KubeConfig, overwrite bool) error {
+	if len(versions) > 0 {
+		namespace := c.v3Namespace(clientset, versions)
+		if c.convertOptions.DryRun {
+			c.plans = append(c.plans, c.planConversion(versions, clientset))
+		} else {
+			change, err := c.recordConversion(clientset, namespace, versions)
+			if err != nil {
+				return err
+			}
+			change.overwritten = overwrite
+			c.changes = append(c.changes, change)
+		}
+
+		if overwrite {
+			if err := c.removeV3Records(clientset, namespace); err != nil {
+				return err
+			}
+		}
+
 		if !c.convertOptions.DeleteRelease {
 			if err := c.convertReleaseCmd.ConvertRelease(c.convertOptions, kc); err != nil {
 				return err
 			}
 
-			if err := c.preserveV2ReleaseConfigmaps(clientset, configmaps, "converted-to-helm3"); err != nil {
+			// a dry run only reports the relabelling, and local releases aren't relabelled
+			if c.convertOptions.DryRun || c.storage == localStorage {
+				return nil
+			}
+
+			if err := c.preserveV2Releases(clientset, versions); err != nil {
 				return err
 			}
 		} else {
@@ -154,48 +449,143 @@ func (c *Convert) doConvert(configmaps *corev1.ConfigMapList, clientset kubernet
 	return nil
 }
 
-// Execute runs Convert from 2to3 package
-// If a v2 version doesn't exists then convertcmd.Convert will error
-// If a V3 version exists, we assume that was migrated and the conversion is not run
-func (c *Convert) Execute() error {
+// convertRelease converts the release that convertOptions points at, if it has v2 versions. When it also has a v3
+// release, convert_conflict_policy decides what happens. It returns the v3 release's status, if there was one, and
+// whether the release was converted.
+func (c *Convert) convertRelease(clientset kubernetes.Interface, actions actionsFor, kc common.KubeConfig) (string, bool, error) {
+	versions, err := c.getV2Releases(clientset)
+	if err != nil || len(versions) == 0 {
+		return "", false, err
+	}
 
+	// release names are only unique within a namespace, so only a v3 release in the namespace the conversion writes to
+	// is a conflict
+	actionCfg, err := actions(c.v3Namespace(clientset, versions))
+	if err != nil {
+		return "", false, err
+	}
 	release := c.convertOptions.ReleaseName
+	status, found := v3ReleaseStatus(release, actionCfg)
+	if found {
+		switch c.conflictPolicy {
+		case conflictFail:
+			return status, false, fmt.Errorf("release %s has both v2 and v3 records, and its v3 release is %s", release, status)
+		case conflictOverwrite:
+			// doConvert removes the v3 records once they've been recorded
+		default:
+			// If there's already a v3 Release, we assume it was migrated
+			return status, false, nil
+		}
+	}
 
-	settings := cli.New()
-	actionCfg := new(action.Configuration)
-	if err := actionCfg.Init(settings.RESTClientGetter(), c.namespace, "secrets", c.debug); err != nil {
+	return status, true, c.doConvert(versions, clientset, kc, found)
+}
+
+// removeV3Records deletes the release's helm v3 records in the namespace, so convert_conflict_policy "overwrite" can
+// convert over them
+func (c *Convert) removeV3Records(clientset kubernetes.Interface, namespace string) error {
+	records, err := v3Records(clientset, namespace, c.convertOptions.ReleaseName)
+	if err != nil {
 		return err
 	}
 
-	// If there's already a v3 Release, migration shouldn't run
-	if v3ReleaseFound(release, actionCfg) {
-		return nil
+	for _, record := range records {
+		log.Printf("Removing v3 record %s/%s", record.Namespace, record.Name)
+		if c.convertOptions.DryRun {
+			continue
+		}
+		err := clientset.CoreV1().Secrets(record.Namespace).Delete(ctx.Background(), record.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("could not remove v3 record %s: %w", record.Name, err)
+		}
 	}
+	return nil
+}
+
+// Execute runs Convert from 2to3 package
+// If a v2 version doesn't exists then convertcmd.Convert will error
+// If a V3 version exists, convert_conflict_policy decides whether the conversion is run
+func (c *Convert) Execute() error {
 
 	kc := common.KubeConfig{
 		File:    c.kubeConfig,
 		Context: c.kubeContext,
 	}
 
-	clientset, err := clientsetFromFile(c.kubeConfig)
+	clientset, err := clientsetFromFile(c.kubeConfig, c.cluster)
 	if err != nil {
 		return err
 	}
+	c.clientset = clientset
 
-	configmaps, err := c.getV2ReleaseConfigmaps(clientset)
-	if err != nil {
-		return err
+	if c.all {
+		err = c.convertAll(clientset, c.actions(), kc)
+	} else {
+		_, _, err = c.convertRelease(clientset, c.actions(), kc)
 	}
 
-	return c.doConvert(configmaps, clientset, kc)
+	if c.convertOptions.DryRun {
+		if reportErr := c.printDryRunReport(); err == nil {
+			err = reportErr
+		}
+	}
+	return err
 }
 
 // Prepare checks required inputs
 func (c *Convert) Prepare() error {
 
-	if c.convertOptions.ReleaseName == "" {
+	if c.convertOptions.ReleaseName == "" && !c.all {
 		return fmt.Errorf("release is required")
 	}
 
+	for _, pattern := range append(c.include, c.exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid release pattern '%s': %w", pattern, err)
+		}
+	}
+
+	switch c.storage {
+	case configmapStorage, secretStorage:
+	case localStorage:
+		if c.releasePath == "" {
+			return fmt.Errorf("v2_release_path is required when tiller_storage is '%s'", localStorage)
+		}
+		if c.convertOptions.DeleteRelease {
+			return fmt.Errorf("delete_v2_releases can't be used when tiller_storage is '%s'", localStorage)
+		}
+	default:
+		return fmt.Errorf("tiller_storage must be '%s', '%s' or '%s'", configmapStorage, secretStorage, localStorage)
+	}
+
+	switch c.conflictPolicy {
+	case conflictSkip, conflictFail, conflictOverwrite:
+	default:
+		return fmt.Errorf("convert_conflict_policy must be '%s', '%s' or '%s'", conflictSkip, conflictFail, conflictOverwrite)
+	}
+
+	if err := c.checkPreserveLabel(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// checkPreserveLabel makes sure v2_preserve_label is a valid key=value label that leaves Tiller's other labels alone
+func (c *Convert) checkPreserveLabel() error {
+	if !strings.Contains(c.preserveLabel, "=") {
+		return fmt.Errorf("v2_preserve_label must be key=value, not '%s'", c.preserveLabel)
+	}
+	errs := append(validation.IsQualifiedName(c.preserveKey), validation.IsValidLabelValue(c.preserveValue)...)
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid v2_preserve_label '%s': %s", c.preserveLabel, strings.Join(errs, "; "))
+	}
+	switch c.preserveKey {
+	case "NAME", "STATUS", "VERSION":
+		return fmt.Errorf("v2_preserve_label can't replace Tiller's %s label", c.preserveKey)
+	}
+	if c.preserveKey == ownerLabel && c.preserveValue == "TILLER" {
+		return fmt.Errorf("v2_preserve_label must take the release away from Tiller, so it can't be OWNER=TILLER")
+	}
 	return nil
 }
@@ -2,8 +2,14 @@ package run
 
 import (
 	ctx "context"
+	"errors"
 	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/mongodb-forks/drone-helm3/internal/env"
 
@@ -17,9 +23,12 @@ import (
 	"helm.sh/helm/v3/pkg/storage/driver"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 func mockActions(t *testing.T) *action.Configuration {
@@ -34,77 +43,123 @@ func mockActions(t *testing.T) *action.Configuration {
 	return a
 }
 
+// namespacedActions stores v3 releases in memory, and returns action configurations that only see the releases in
+// the namespace they're for
+func namespacedActions(t *testing.T, releases ...*release.Release) actionsFor {
+	actionCfg := mockActions(t)
+	memory := driver.NewMemory()
+	actionCfg.Releases = storage.Init(memory)
+	for _, rel := range releases {
+		require.NoError(t, actionCfg.Releases.Create(rel))
+	}
+	return func(namespace string) (*action.Configuration, error) {
+		memory.SetNamespace(namespace)
+		return actionCfg, nil
+	}
+}
+
 type convertCmdMock struct {
 	Called int
+	Errors map[string]error
 }
 
 func (c *convertCmdMock) ConvertRelease(convertOptions convertcmd.ConvertOptions, kubeConfig common.KubeConfig) error {
 	c.Called++
-	return nil
+	return c.Errors[convertOptions.ReleaseName]
 }
 
-func TestV3ReleaseFound(t *testing.T) {
+func TestV3ReleaseStatus(t *testing.T) {
 
 	cfg := mockActions(t)
 
-	opts := &release.MockReleaseOptions{
-		Name: "myapp",
+	for _, opts := range []*release.MockReleaseOptions{
+		{Name: "myapp", Version: 1, Status: release.StatusDeployed},
+		{Name: "myapp", Version: 2, Status: release.StatusFailed},
+		{Name: "installing", Version: 1, Status: release.StatusPendingInstall},
+	} {
+		require.NoError(t, cfg.Releases.Create(release.Mock(opts)))
 	}
 
-	err := cfg.Releases.Create(release.Mock(opts))
+	status, found := v3ReleaseStatus("myapp", cfg)
+	assert.True(t, found)
+	assert.Equal(t, "failed", status, "the latest revision's status should be reported")
+
+	status, found = v3ReleaseStatus("installing", cfg)
+	assert.True(t, found, "a release with no deployed revision still exists")
+	assert.Equal(t, "pending-install", status)
+
+	_, found = v3ReleaseStatus("doesnt_exists", cfg)
+	assert.False(t, found)
+}
+
+func TestV3ReleaseDeployed(t *testing.T) {
+
+	cfg := mockActions(t)
+
+	err := cfg.Releases.Create(release.Mock(&release.MockReleaseOptions{Name: "myapp"}))
+	assert.NoError(t, err)
+	err = cfg.Releases.Create(release.Mock(&release.MockReleaseOptions{Name: "broken", Status: release.StatusFailed}))
 	assert.NoError(t, err)
 
-	assert.True(t, v3ReleaseFound("myapp", cfg))
-	assert.False(t, v3ReleaseFound("doesnt_exists", cfg))
+	assert.True(t, v3ReleaseDeployed("myapp", cfg))
+	assert.False(t, v3ReleaseDeployed("broken", cfg))
+	assert.False(t, v3ReleaseDeployed("doesnt_exists", cfg))
 }
 
-func clientsetWithNoV2ConfigmapsMock() *fake.Clientset {
+func v2ReleaseMeta(name, release, version string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:      name,
+		Namespace: "example",
+		Labels: map[string]string{
+			"NAME":    release,
+			"OWNER":   "TILLER",
+			"STATUS":  "DEPLOYED",
+			"VERSION": version,
+		},
+	}
+}
+
+func clientsetWithNoV2ReleasesMock() *fake.Clientset {
 
 	return fake.NewSimpleClientset(
 		&corev1.ConfigMap{},
+		&corev1.Secret{},
 	)
 }
 
-func clientsetWithV2ConfigmapsMock() *fake.Clientset {
+// clientsetWithV2ReleasesMock returns a clientset with myapp's versions stored the way Tiller's storage backend
+// would store them, plus an unrelated release.
+func clientsetWithV2ReleasesMock(storage string) *fake.Clientset {
 
-	return fake.NewSimpleClientset(
-		&corev1.ConfigMap{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      "myapp.v1",
-				Namespace: "example",
-				Labels: map[string]string{
-					"NAME":    "myapp",
-					"OWNER":   "TILLER",
-					"STATUS":  "DEPLOYED",
-					"VERSION": "1",
-				},
-			},
-		},
-		&corev1.ConfigMap{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      "myapp.v2",
-				Namespace: "example",
-				Labels: map[string]string{
-					"NAME":    "myapp",
-					"OWNER":   "TILLER",
-					"STATUS":  "DEPLOYED",
-					"VERSION": "2",
-				},
-			},
-		},
-		&corev1.ConfigMap{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      "other.v1",
-				Namespace: "example",
-				Labels: map[string]string{
-					"NAME":    "other",
-					"OWNER":   "TILLER",
-					"STATUS":  "DEPLOYED",
-					"VERSION": "1",
-				},
-			},
-		},
-	)
+	metas := []metav1.ObjectMeta{
+		v2ReleaseMeta("myapp.v1", "myapp", "1"),
+		v2ReleaseMeta("myapp.v2", "myapp", "2"),
+		v2ReleaseMeta("other.v1", "other", "1"),
+	}
+
+	var objects []runtime.Object
+	for _, meta := range metas {
+		if storage == secretStorage {
+			objects = append(objects, &corev1.Secret{ObjectMeta: meta, Data: map[string][]byte{"release": []byte("H4sI")}})
+		} else {
+			objects = append(objects, &corev1.ConfigMap{ObjectMeta: meta, Data: map[string]string{"release": "H4sI"}})
+		}
+	}
+	return fake.NewSimpleClientset(objects...)
+}
+
+// v2ReleaseOwner returns the OWNER label of a stored release version, and checks that its release data is intact.
+func v2ReleaseOwner(t *testing.T, clientset *fake.Clientset, storage, name string) string {
+	if storage == secretStorage {
+		secret, err := clientset.CoreV1().Secrets("example").Get(ctx.Background(), name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []byte("H4sI"), secret.Data["release"])
+		return secret.Labels["OWNER"]
+	}
+	cm, err := clientset.CoreV1().ConfigMaps("example").Get(ctx.Background(), name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "H4sI", cm.Data["release"])
+	return cm.Labels["OWNER"]
 }
 
 func TestTillerNSValue(t *testing.T) {
@@ -132,144 +187,312 @@ func TestTillerNSValue(t *testing.T) {
 	}
 }
 
-func TestGetV2ReleaseConfigmaps(t *testing.T) {
+func TestTillerStorage(t *testing.T) {
 
-	c := NewConvert(env.Config{Release: "myapp", TillerNS: "example"}, "", "")
-	clientset := clientsetWithV2ConfigmapsMock()
-
-	expectedConfigmaps := &corev1.ConfigMapList{
-		Items: []corev1.ConfigMap{
-			corev1.ConfigMap{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      "myapp.v1",
-					Namespace: "example",
-					Labels: map[string]string{
-						"NAME":    "myapp",
-						"OWNER":   "TILLER",
-						"STATUS":  "DEPLOYED",
-						"VERSION": "1",
-					},
-				},
-			},
-			corev1.ConfigMap{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      "myapp.v2",
-					Namespace: "example",
-					Labels: map[string]string{
-						"NAME":    "myapp",
-						"OWNER":   "TILLER",
-						"STATUS":  "DEPLOYED",
-						"VERSION": "2",
-					},
-				},
-			},
-		},
-	}
+	c := NewConvert(env.Config{Release: "myapp"}, "", "")
+	assert.NoError(t, c.Prepare())
+	assert.Equal(t, configmapStorage, c.storage)
+	assert.Equal(t, "configmaps", c.convertOptions.StorageType)
 
-	cmaps, err := c.getV2ReleaseConfigmaps(clientset)
-	assert.NoError(t, err)
-	assert.Equal(t, len(cmaps.Items), 2)
-	assert.Equal(t, cmaps, expectedConfigmaps)
-}
+	c = NewConvert(env.Config{Release: "myapp", TillerStorage: "secret"}, "", "")
+	assert.NoError(t, c.Prepare())
+	assert.Equal(t, "secrets", c.convertOptions.StorageType)
 
-func TestPreserveV2ReleaseConfigmaps(t *testing.T) {
+	c = NewConvert(env.Config{Release: "myapp", TillerStorage: "sql"}, "", "")
+	assert.EqualError(t, c.Prepare(), "tiller_storage must be 'configmap', 'secret' or 'local'")
 
-	c := NewConvert(env.Config{Release: "myapp", TillerNS: "example"}, "", "")
-	clientset := clientsetWithV2ConfigmapsMock()
+	c = NewConvert(env.Config{Release: "myapp", TillerStorage: "secret", TillerOutCluster: true}, "", "")
+	assert.NoError(t, c.Prepare())
+	assert.True(t, c.convertOptions.TillerOutCluster)
+}
 
-	cmaps, err := c.getV2ReleaseConfigmaps(clientset)
-	assert.NoError(t, err)
+func TestConvertConflictPolicy(t *testing.T) {
 
-	err = c.preserveV2ReleaseConfigmaps(clientset, cmaps, "none")
-	assert.NoError(t, err)
+	c := NewConvert(env.Config{Release: "myapp"}, "", "")
+	assert.NoError(t, c.Prepare())
+	assert.Equal(t, conflictSkip, c.conflictPolicy)
+
+	c = NewConvert(env.Config{Release: "myapp", ConvertConflictPolicy: "replace"}, "", "")
+	assert.EqualError(t, c.Prepare(), "convert_conflict_policy must be 'skip', 'fail' or 'overwrite'")
 
 	tests := []struct {
-		namespace       string
-		configmapName   string
-		ownerLabelValue string
+		policy    string
+		converted bool
+		err       string
 	}{
-		{
-			namespace:       "example",
-			configmapName:   "myapp.v1",
-			ownerLabelValue: "none",
-		},
-		{
-			namespace:       "example",
-			configmapName:   "myapp.v2",
-			ownerLabelValue: "none",
-		},
-		{
-			namespace:       "example",
-			configmapName:   "other.v1",
-			ownerLabelValue: "TILLER",
-		},
+		{policy: conflictSkip},
+		{policy: conflictFail, err: "release myapp has both v2 and v3 records, and its v3 release is failed"},
+		{policy: conflictOverwrite, converted: true},
 	}
-
 	for _, test := range tests {
-		cm, err := clientset.CoreV1().ConfigMaps(test.namespace).Get(ctx.Background(), test.configmapName, metav1.GetOptions{})
-		assert.NoError(t, err)
-		assert.Equal(t, cm.Labels["OWNER"], test.ownerLabelValue)
+		t.Run(test.policy, func(t *testing.T) {
+			c := NewConvert(env.Config{Release: "myapp", Namespace: "production", TillerNS: "example", ConvertConflictPolicy: test.policy}, "", "")
+			releaseMock := &convertCmdMock{}
+			c.convertReleaseCmd = releaseMock
+			clientset := clientsetWithV2ReleasesMock(configmapStorage)
+			_, err := clientset.CoreV1().Secrets("production").Create(ctx.Background(), v3Record("production", "myapp", "1"), metav1.CreateOptions{})
+			require.NoError(t, err)
+			// a different release with the same name
+			_, err = clientset.CoreV1().Secrets("staging").Create(ctx.Background(), v3Record("staging", "myapp", "1"), metav1.CreateOptions{})
+			require.NoError(t, err)
+
+			// a v3 release that never deployed is still a conflict
+			actions := namespacedActions(t, release.Mock(&release.MockReleaseOptions{Name: "myapp", Namespace: "production", Status: release.StatusFailed}))
+
+			status, converted, err := c.convertRelease(clientset, actions, common.KubeConfig{})
+			if test.err != "" {
+				assert.EqualError(t, err, test.err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, "failed", status)
+			assert.Equal(t, test.converted, converted)
+
+			records, err := v3Records(clientset, "production", "myapp")
+			require.NoError(t, err)
+			if test.converted {
+				assert.Equal(t, 1, releaseMock.Called)
+				assert.Empty(t, records, "the old v3 records should be removed before converting")
+				assert.Equal(t, "converted-to-helm3", v2ReleaseOwner(t, clientset, configmapStorage, "myapp.v1"))
+			} else {
+				assert.Equal(t, 0, releaseMock.Called)
+				assert.Len(t, records, 1)
+				assert.Equal(t, "TILLER", v2ReleaseOwner(t, clientset, configmapStorage, "myapp.v1"))
+			}
+			records, err = v3Records(clientset, "staging", "myapp")
+			require.NoError(t, err)
+			assert.Len(t, records, 1, "releases in other namespaces should be left alone")
+		})
 	}
 }
 
-func TestDoConvertWithV2Release(t *testing.T) {
-	c := NewConvert(env.Config{Release: "myapp", TillerNS: "example"}, "", "")
-	clientset := clientsetWithV2ConfigmapsMock()
-	c.convertReleaseCmd = &convertCmdMock{}
+func TestConvertReleaseWithoutV3Release(t *testing.T) {
 
-	cmaps, err := c.getV2ReleaseConfigmaps(clientset)
+	c := NewConvert(env.Config{Release: "myapp", TillerNS: "example", ConvertConflictPolicy: conflictFail}, "", "")
+	releaseMock := &convertCmdMock{}
+	c.convertReleaseCmd = releaseMock
 
+	status, converted, err := c.convertRelease(clientsetWithV2ReleasesMock(configmapStorage), namespacedActions(t), common.KubeConfig{})
 	assert.NoError(t, err)
+	assert.Empty(t, status)
+	assert.True(t, converted)
+	assert.Equal(t, 1, releaseMock.Called)
+}
 
-	// common.KubeConfig is not used in our moock of the convertCmd
-	err = c.doConvert(cmaps, clientset, common.KubeConfig{})
+func TestGetV2Releases(t *testing.T) {
+
+	for _, storage := range []string{configmapStorage, secretStorage} {
+		t.Run(storage, func(t *testing.T) {
+			c := NewConvert(env.Config{Release: "myapp", TillerNS: "example", TillerStorage: storage}, "", "")
+			clientset := clientsetWithV2ReleasesMock(storage)
+
+			versions, err := c.getV2Releases(clientset)
+			assert.NoError(t, err)
+			assert.Equal(t, []metav1.ObjectMeta{
+				v2ReleaseMeta("myapp.v1", "myapp", "1"),
+				v2ReleaseMeta("myapp.v2", "myapp", "2"),
+			}, versions)
+		})
+	}
+}
+
+func TestGetV2ReleasesOnlyReadsTillerStorage(t *testing.T) {
+
+	c := NewConvert(env.Config{Release: "myapp", TillerNS: "example", TillerStorage: secretStorage}, "", "")
+	clientset := clientsetWithV2ReleasesMock(configmapStorage)
+
+	versions, err := c.getV2Releases(clientset)
 	assert.NoError(t, err)
-	// assert configmaps
+	assert.Empty(t, versions)
+}
 
-	tests := []struct {
-		namespace       string
-		configmapName   string
-		ownerLabelValue string
-	}{
-		{
-			namespace:       "example",
-			configmapName:   "myapp.v1",
-			ownerLabelValue: "converted-to-helm3",
-		},
-		{
-			namespace:       "example",
-			configmapName:   "myapp.v2",
-			ownerLabelValue: "converted-to-helm3",
-		},
-		{
-			namespace:       "example",
-			configmapName:   "other.v1",
-			ownerLabelValue: "TILLER",
-		},
+func TestPreserveV2Releases(t *testing.T) {
+
+	for _, storage := range []string{configmapStorage, secretStorage} {
+		t.Run(storage, func(t *testing.T) {
+			c := NewConvert(env.Config{Release: "myapp", TillerNS: "example", TillerStorage: storage, V2PreserveLabel: "OWNER=none"}, "", "")
+			clientset := clientsetWithV2ReleasesMock(storage)
+
+			versions, err := c.getV2Releases(clientset)
+			assert.NoError(t, err)
+
+			err = c.preserveV2Releases(clientset, versions)
+			assert.NoError(t, err)
+
+			assert.Equal(t, "none", v2ReleaseOwner(t, clientset, storage, "myapp.v1"))
+			assert.Equal(t, "none", v2ReleaseOwner(t, clientset, storage, "myapp.v2"))
+			assert.Equal(t, "TILLER", v2ReleaseOwner(t, clientset, storage, "other.v1"))
+
+			preserved, err := c.listV2Releases(clientset, "NAME=myapp")
+			require.NoError(t, err)
+			assert.WithinDuration(t, time.Now(), convertedAt(preserved[0]), time.Minute)
+		})
 	}
+}
 
-	for _, test := range tests {
-		cm, err := clientset.CoreV1().ConfigMaps(test.namespace).Get(ctx.Background(), test.configmapName, metav1.GetOptions{})
-		assert.NoError(t, err)
-		assert.Equal(t, cm.Labels["OWNER"], test.ownerLabelValue)
+func TestPreserveV2ReleasesWithCustomLabel(t *testing.T) {
+
+	c := NewConvert(env.Config{
+		Release:         "myapp",
+		TillerNS:        "example",
+		V2PreserveLabel: "migrated-to=helm3",
+		Repo:            "octocat/hello-world",
+		BuildNumber:     "42",
+	}, "", "")
+	clientset := clientsetWithV2ReleasesMock(configmapStorage)
+
+	versions, err := c.getV2Releases(clientset)
+	require.NoError(t, err)
+	require.NoError(t, c.preserveV2Releases(clientset, versions))
+
+	preserved, err := c.listV2Releases(clientset, "migrated-to=helm3")
+	require.NoError(t, err)
+	require.Len(t, preserved, 2)
+	assert.NotContains(t, preserved[0].Labels, "OWNER", "Tiller shouldn't see the release any more")
+	assert.Equal(t, "Drone build 42 of octocat/hello-world", preserved[0].Annotations[convertedByAnnotation])
+
+	require.NoError(t, c.restoreV2Versions(clientset, versions))
+	restored, err := c.getV2Releases(clientset)
+	require.NoError(t, err)
+	require.Len(t, restored, 2)
+	assert.Equal(t, versions[0].Labels, restored[0].Labels)
+	assert.Empty(t, restored[0].Annotations)
+}
+
+func TestPreserveV2ReleasesRestoresOnFailure(t *testing.T) {
+
+	c := NewConvert(env.Config{Release: "myapp", TillerNS: "example"}, "", "")
+	clientset := clientsetWithV2ReleasesMock(configmapStorage)
+	clientset.PrependReactor("patch", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		if patch.GetName() == "myapp.v2" && strings.Contains(string(patch.GetPatch()), "converted-to-helm3") {
+			return true, nil, errors.New("the server is currently unable to handle the request")
+		}
+		return false, nil, nil
+	})
+
+	versions, err := c.getV2Releases(clientset)
+	require.NoError(t, err)
+	err = c.preserveV2Releases(clientset, versions)
+	assert.EqualError(t, err, "Failure preserving release version myapp.v2: the server is currently unable to handle the request")
+
+	restored, err := c.getV2Releases(clientset)
+	require.NoError(t, err)
+	require.Len(t, restored, 2, "myapp.v1 should be handed back to Tiller")
+	assert.Empty(t, restored[0].Annotations)
+}
+
+func TestPreserveLabelPrepare(t *testing.T) {
+
+	tests := map[string]string{
+		"OWNER=converted": "",
+		"migrated=":       "",
+		"migrated":        "v2_preserve_label must be key=value, not 'migrated'",
+		"=helm3":          "invalid v2_preserve_label '=helm3': name part must be non-empty; name part must consist of alphanumeric characters, '-', '_' or '.', and must start and end with an alphanumeric character (e.g. 'MyName',  or 'my.name',  or '123-abc', regex used for validation is '([A-Za-z0-9][-A-Za-z0-9_.]*)?[A-Za-z0-9]')",
+		"NAME=converted":  "v2_preserve_label can't replace Tiller's NAME label",
+		"OWNER=TILLER":    "v2_preserve_label must take the release away from Tiller, so it can't be OWNER=TILLER",
+	}
+	for label, expected := range tests {
+		c := NewConvert(env.Config{Release: "myapp", V2PreserveLabel: label}, "", "")
+		if expected == "" {
+			assert.NoError(t, c.Prepare(), label)
+		} else {
+			assert.EqualError(t, c.Prepare(), expected, label)
+		}
+	}
+}
+
+func TestDoConvertWithV2Release(t *testing.T) {
+
+	for _, storage := range []string{configmapStorage, secretStorage} {
+		t.Run(storage, func(t *testing.T) {
+			c := NewConvert(env.Config{Release: "myapp", TillerNS: "example", TillerStorage: storage}, "", "")
+			clientset := clientsetWithV2ReleasesMock(storage)
+			releaseMock := &convertCmdMock{}
+			c.convertReleaseCmd = releaseMock
+
+			versions, err := c.getV2Releases(clientset)
+			assert.NoError(t, err)
+
+			// common.KubeConfig is not used in our moock of the convertCmd
+			err = c.doConvert(versions, clientset, common.KubeConfig{}, false)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, releaseMock.Called)
+
+			assert.Equal(t, "converted-to-helm3", v2ReleaseOwner(t, clientset, storage, "myapp.v1"))
+			assert.Equal(t, "converted-to-helm3", v2ReleaseOwner(t, clientset, storage, "myapp.v2"))
+			assert.Equal(t, "TILLER", v2ReleaseOwner(t, clientset, storage, "other.v1"))
+		})
 	}
 }
 
 func TestDoConvertNewRelease(t *testing.T) {
 	c := NewConvert(env.Config{Release: "myapp", TillerNS: "example"}, "", "")
-	clientset := clientsetWithNoV2ConfigmapsMock()
+	clientset := clientsetWithNoV2ReleasesMock()
 
 	releaseMock := &convertCmdMock{}
 
 	c.convertReleaseCmd = releaseMock
 
-	cmaps, err := c.getV2ReleaseConfigmaps(clientset)
+	versions, err := c.getV2Releases(clientset)
 	assert.NoError(t, err)
-	assert.Equal(t, len(cmaps.Items), 0)
+	assert.Equal(t, len(versions), 0)
 
 	// common.KubeConfig is not used in our moock of the convertCmd
-	err = c.doConvert(cmaps, clientset, common.KubeConfig{})
+	err = c.doConvert(versions, clientset, common.KubeConfig{}, false)
 	assert.NoError(t, err)
 	// assert that convert was not called, since no v2 releases exist
 	assert.Equal(t, releaseMock.Called, 0)
 }
+
+func TestRestConfigFromFileHonorsClusterSettings(t *testing.T) {
+	kubeConfig, err := tempfile("kubeconfig********.yml", `
+apiVersion: v1
+kind: Config
+clusters:
+- cluster:
+    certificate-authority-data: Y2VydGlmaWNhdGU=
+    server: https://10.0.0.1
+  name: helm
+contexts:
+- context:
+    cluster: helm
+    user: helm
+  name: helm
+current-context: helm
+users:
+- name: helm
+  user:
+    token: dG9rZW4=
+`)
+	require.NoError(t, err)
+	defer os.Remove(kubeConfig.Name())
+
+	caFile, err := tempfile("cluster-ca********.pem", "certificate")
+	require.NoError(t, err)
+	defer os.Remove(caFile.Name())
+
+	cfg := env.Config{
+		ProxyURL:        "https://proxy.example.com:3128",
+		TLSServerName:   "kubernetes.example.com",
+		CertificateFile: caFile.Name(),
+	}
+	restConfig, err := restConfigFromFile(kubeConfig.Name(), kubeCluster(cfg))
+	require.NoError(t, err)
+
+	assert.Equal(t, "kubernetes.example.com", restConfig.TLSClientConfig.ServerName)
+	assert.Equal(t, caFile.Name(), restConfig.TLSClientConfig.CAFile)
+	assert.Empty(t, restConfig.TLSClientConfig.CAData)
+
+	proxy, err := restConfig.Proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: "10.0.0.1"}})
+	require.NoError(t, err)
+	assert.Equal(t, "https://proxy.example.com:3128", proxy.String())
+}
+
+func TestKubeClusterPrefersInlineCertificate(t *testing.T) {
+	cluster := kubeCluster(env.Config{Certificate: "Y2VydGlmaWNhdGU=", CertificateFile: "/etc/ssl/cluster-ca.pem"})
+	assert.Empty(t, cluster.CertificateAuthority)
+
+	cluster = kubeCluster(env.Config{SkipTLSVerify: true, CertificateFile: "/etc/ssl/cluster-ca.pem"})
+	assert.Empty(t, cluster.CertificateAuthority)
+}
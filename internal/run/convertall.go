@@ -0,0 +1,114 @@
+package run
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/helm/helm-2to3/pkg/common"
+	"k8s.io/client-go/kubernetes"
+)
+
+// convertReport sorts the releases convert_all found by what happened to them
+type convertReport struct {
+	converted []string
+	alreadyV3 []string
+	skipped   []string
+	failed    []convertFailure
+}
+
+type convertFailure struct {
+	release string
+	err     error
+}
+
+// convertAll converts every v2 release in the Tiller namespace that passes the include and exclude filters, then
+// prints a report. A release that fails to convert doesn't stop the others.
+func (c *Convert) convertAll(clientset kubernetes.Interface, actions actionsFor, kc common.KubeConfig) error {
+	releases, err := c.v2ReleaseNames(clientset)
+	if err != nil {
+		return err
+	}
+
+	report := &convertReport{}
+	for _, release := range releases {
+		switch {
+		case !c.selected(release):
+			report.skipped = append(report.skipped, release)
+		default:
+			c.forRelease(release)
+			status, converted, err := c.convertRelease(clientset, actions, kc)
+			switch {
+			case err != nil:
+				report.failed = append(report.failed, convertFailure{release: release, err: err})
+			case !converted:
+				report.alreadyV3 = append(report.alreadyV3, fmt.Sprintf("%s (%s)", release, status))
+			default:
+				report.converted = append(report.converted, release)
+			}
+		}
+	}
+
+	report.print(c.stdout)
+	if len(report.failed) > 0 {
+		return fmt.Errorf("failed to convert %d of %d v2 releases", len(report.failed), len(releases))
+	}
+	return nil
+}
+
+// v2ReleaseNames returns the distinct NAME labels of Tiller's release records, sorted
+func (c *Convert) v2ReleaseNames(clientset kubernetes.Interface) ([]string, error) {
+	versions, err := c.listV2Releases(clientset, c.tillerLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, version := range versions {
+		name := version.Labels["NAME"]
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// selected reports whether a release matches one of the include patterns, if there are any, and none of the
+// exclude patterns
+func (c *Convert) selected(release string) bool {
+	matches := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			// patterns are checked in Prepare
+			if ok, _ := path.Match(pattern, release); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return (len(c.include) == 0 || matches(c.include)) && !matches(c.exclude)
+}
+
+func (r *convertReport) print(out io.Writer) {
+	fmt.Fprintf(out, "v2 conversion report:\n")
+	for _, group := range []struct {
+		label    string
+		releases []string
+	}{
+		{"converted", r.converted},
+		{"already v3", r.alreadyV3},
+		{"skipped", r.skipped},
+	} {
+		line := fmt.Sprintf("  %s (%d): %s", group.label, len(group.releases), strings.Join(group.releases, ", "))
+		fmt.Fprintln(out, strings.TrimRight(line, " "))
+	}
+	fmt.Fprintf(out, "  failed (%d):\n", len(r.failed))
+	for _, failure := range r.failed {
+		fmt.Fprintf(out, "    %s: %s\n", failure.release, failure.err)
+	}
+}
@@ -0,0 +1,112 @@
+package run
+
+import (
+	ctx "context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/helm/helm-2to3/pkg/common"
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/release"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	rspb "k8s.io/helm/pkg/proto/hapi/release"
+)
+
+func clientsetWithManyV2ReleasesMock() *fake.Clientset {
+	var objects []runtime.Object
+	for _, version := range [][]string{
+		{"web.v1", "web", "1"},
+		{"web.v2", "web", "2"},
+		{"api.v1", "api", "1"},
+		{"legacy-cron.v1", "legacy-cron", "1"},
+		{"worker.v1", "worker", "1"},
+		{"broken.v3", "broken", "3"},
+	} {
+		objects = append(objects, &corev1.ConfigMap{ObjectMeta: v2ReleaseMeta(version[0], version[1], version[2])})
+	}
+	return fake.NewSimpleClientset(objects...)
+}
+
+func TestConvertAllPrepare(t *testing.T) {
+	c := NewConvert(env.Config{ConvertAll: true}, "", "")
+	assert.NoError(t, c.Prepare(), "convert_all doesn't need a release")
+
+	c = NewConvert(env.Config{ConvertAll: true, ConvertExclude: []string{"legacy-["}}, "", "")
+	assert.EqualError(t, c.Prepare(), "invalid release pattern 'legacy-[': syntax error in pattern")
+}
+
+func TestV2ReleaseNames(t *testing.T) {
+	c := NewConvert(env.Config{ConvertAll: true, TillerNS: "example"}, "", "")
+
+	names, err := c.v2ReleaseNames(clientsetWithManyV2ReleasesMock())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"api", "broken", "legacy-cron", "web", "worker"}, names)
+}
+
+func TestSelected(t *testing.T) {
+	c := NewConvert(env.Config{ConvertAll: true}, "", "")
+	assert.True(t, c.selected("anything"))
+
+	c = NewConvert(env.Config{ConvertAll: true, ConvertInclude: []string{"web*", "api"}, ConvertExclude: []string{"*-canary"}}, "", "")
+	assert.True(t, c.selected("web"))
+	assert.True(t, c.selected("webhooks"))
+	assert.True(t, c.selected("api"))
+	assert.False(t, c.selected("api-v2"))
+	assert.False(t, c.selected("web-canary"))
+}
+
+func TestConvertAll(t *testing.T) {
+	stdout := &strings.Builder{}
+	c := NewConvert(env.Config{
+		ConvertAll:     true,
+		TillerNS:       "example",
+		ConvertExclude: []string{"legacy-*"},
+		Stdout:         stdout,
+	}, "", "")
+	releaseMock := &convertCmdMock{Errors: map[string]error{"broken": errors.New("release data is corrupt")}}
+	c.convertReleaseCmd = releaseMock
+	clientset := clientsetWithManyV2ReleasesMock()
+
+	actions := namespacedActions(t, release.Mock(&release.MockReleaseOptions{Name: "api"}))
+
+	err := c.convertAll(clientset, actions, common.KubeConfig{})
+	assert.EqualError(t, err, "failed to convert 1 of 5 v2 releases")
+	assert.Equal(t, 3, releaseMock.Called)
+
+	assert.Equal(t, `v2 conversion report:
+  converted (2): web, worker
+  already v3 (1): api (deployed)
+  skipped (1): legacy-cron
+  failed (1):
+    broken: release data is corrupt
+`, stdout.String())
+
+	web, err := clientset.CoreV1().ConfigMaps("example").Get(ctx.Background(), "web.v2", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "converted-to-helm3", web.Labels["OWNER"])
+	legacy, err := clientset.CoreV1().ConfigMaps("example").Get(ctx.Background(), "legacy-cron.v1", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "TILLER", legacy.Labels["OWNER"])
+}
+
+func TestConvertAllLooksForV3ReleasesInTheirNamespace(t *testing.T) {
+	stdout := &strings.Builder{}
+	c := NewConvert(env.Config{ConvertAll: true, TillerNS: "example", Stdout: stdout}, "", "")
+	releaseMock := &convertCmdMock{}
+	c.convertReleaseCmd = releaseMock
+	data := encodeV2Release(t, &rspb.Release{Name: "web", Namespace: "production", Version: 1})
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{ObjectMeta: v2ReleaseMeta("web.v1", "web", "1"), Data: map[string]string{"release": data}})
+
+	// a different release with the same name
+	actions := namespacedActions(t, release.Mock(&release.MockReleaseOptions{Name: "web", Namespace: "staging"}))
+
+	require.NoError(t, c.convertAll(clientset, actions, common.KubeConfig{}))
+	assert.Equal(t, 1, releaseMock.Called)
+	assert.Contains(t, stdout.String(), "converted (1): web\n")
+}
@@ -0,0 +1,148 @@
+package run
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	convertcmd "github.com/helm/helm-2to3/cmd"
+	"github.com/helm/helm-2to3/pkg/common"
+	v2 "github.com/helm/helm-2to3/pkg/v2"
+	v3 "github.com/helm/helm-2to3/pkg/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	rspb "k8s.io/helm/pkg/proto/hapi/release"
+)
+
+// localStorage is the tiller_storage for releases that aren't in the cluster, such as those a Tillerless setup kept
+// on the machine that ran Tiller. They're read from v2_release_path instead.
+const localStorage = "local"
+
+// readLocalReleases decodes the v2 releases in v2_release_path, which is either one file or a directory of them. Each
+// file holds a release version the way Tiller encodes it, as in the `release` field of its configmaps.
+func readLocalReleases(path string) ([]*rspb.Release, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read v2_release_path: %w", err)
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read v2_release_path: %w", err)
+		}
+		files = nil
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+
+	var releases []*rspb.Release
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read v2 release file: %w", err)
+		}
+		release, err := decodeV2Release(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("could not decode the v2 release in %s: %w", file, err)
+		}
+		releases = append(releases, release)
+	}
+	return releases, nil
+}
+
+// localReleaseMeta returns the metadata Tiller would have given the release version's configmap
+func localReleaseMeta(release *rspb.Release) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name: v2.GetReleaseVersionName(release.Name, release.Version),
+		Labels: map[string]string{
+			"NAME":    release.Name,
+			"OWNER":   "TILLER",
+			"STATUS":  release.GetInfo().GetStatus().GetCode().String(),
+			"VERSION": strconv.Itoa(int(release.Version)),
+		},
+	}
+}
+
+// listLocalReleases is listV2Releases for releases in v2_release_path
+func (c *Convert) listLocalReleases(selector string) ([]metav1.ObjectMeta, error) {
+	matcher, err := labels.Parse(selector)
+	if err != nil {
+		return nil, err
+	}
+	releases, err := readLocalReleases(c.releasePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []metav1.ObjectMeta
+	for _, release := range releases {
+		meta := localReleaseMeta(release)
+		if matcher.Matches(labels.Set(meta.Labels)) {
+			versions = append(versions, meta)
+		}
+	}
+	return versions, nil
+}
+
+// localReleaseNamespace is v2ReleaseNamespace for releases in v2_release_path
+func (c *Convert) localReleaseNamespace(name string) string {
+	releases, err := readLocalReleases(c.releasePath)
+	if err != nil {
+		return ""
+	}
+	for _, release := range releases {
+		if v2.GetReleaseVersionName(release.Name, release.Version) == name {
+			return release.Namespace
+		}
+	}
+	return ""
+}
+
+// localConvertRelease converts releases from v2_release_path the way 2to3 converts the ones in the cluster, which it
+// can't read from anywhere else. The files are left alone.
+type localConvertRelease struct {
+	path string
+}
+
+func (l *localConvertRelease) ConvertRelease(convertOptions convertcmd.ConvertOptions, kubeConfig common.KubeConfig) error {
+	releases, err := readLocalReleases(l.path)
+	if err != nil {
+		return err
+	}
+
+	var versions []*rspb.Release
+	for _, release := range releases {
+		if release.Name == convertOptions.ReleaseName {
+			versions = append(versions, release)
+		}
+	}
+	sort.Sort(v2.ByReleaseVersion(versions))
+	if max := convertOptions.MaxReleaseVersions; max > 0 && max < len(versions) {
+		versions = versions[len(versions)-max:]
+	}
+
+	for _, v2Release := range versions {
+		name := v2.GetReleaseVersionName(v2Release.Name, v2Release.Version)
+		log.Printf("[Helm 3] ReleaseVersion \"%s\" will be created.", name)
+		if convertOptions.DryRun {
+			continue
+		}
+		v3Release, err := v3.CreateRelease(v2Release)
+		if err != nil {
+			return fmt.Errorf("could not convert v2 release version %s: %w", name, err)
+		}
+		if err := v3.StoreRelease(v3Release, kubeConfig); err != nil {
+			return fmt.Errorf("could not store v3 release version %s: %w", name, err)
+		}
+	}
+	return nil
+}
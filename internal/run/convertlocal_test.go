@@ -0,0 +1,108 @@
+package run
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/helm/helm-2to3/pkg/common"
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+	rspb "k8s.io/helm/pkg/proto/hapi/release"
+)
+
+// localReleasesDir writes release versions to files, the way they'd be saved from a Tillerless setup
+func localReleasesDir(t *testing.T) string {
+	dir := t.TempDir()
+	for _, release := range []*rspb.Release{
+		{Name: "myapp", Namespace: "production", Version: 1, Info: &rspb.Info{Status: &rspb.Status{Code: rspb.Status_SUPERSEDED}}},
+		{Name: "myapp", Namespace: "production", Version: 2, Info: &rspb.Info{Status: &rspb.Status{Code: rspb.Status_DEPLOYED}}},
+		{Name: "other", Namespace: "staging", Version: 1, Info: &rspb.Info{Status: &rspb.Status{Code: rspb.Status_DEPLOYED}}},
+	} {
+		file := filepath.Join(dir, localReleaseMeta(release).Name)
+		require.NoError(t, os.WriteFile(file, []byte(encodeV2Release(t, release)+"\n"), 0644))
+	}
+	return dir
+}
+
+func TestLocalStoragePrepare(t *testing.T) {
+	c := NewConvert(env.Config{Release: "myapp", TillerStorage: "local", V2ReleasePath: "/releases"}, "", "")
+	assert.NoError(t, c.Prepare())
+	assert.IsType(t, &localConvertRelease{}, c.convertReleaseCmd)
+
+	c = NewConvert(env.Config{Release: "myapp", TillerStorage: "local"}, "", "")
+	assert.EqualError(t, c.Prepare(), "v2_release_path is required when tiller_storage is 'local'")
+
+	c = NewConvert(env.Config{Release: "myapp", TillerStorage: "local", V2ReleasePath: "/releases", DeleteV2Releases: true}, "", "")
+	assert.EqualError(t, c.Prepare(), "delete_v2_releases can't be used when tiller_storage is 'local'")
+
+	v := NewV2Cleanup(env.Config{TillerStorage: "local", V2ReleasePath: "/releases"}, "", "")
+	assert.EqualError(t, v.Prepare(), "v2-cleanup can't remove releases when tiller_storage is 'local'")
+}
+
+func TestListLocalReleases(t *testing.T) {
+	dir := localReleasesDir(t)
+	c := NewConvert(env.Config{Release: "myapp", TillerStorage: "local", V2ReleasePath: dir}, "", "")
+
+	versions, err := c.getV2Releases(fake.NewSimpleClientset())
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, "myapp.v1", versions[0].Name)
+	assert.Equal(t, map[string]string{"NAME": "myapp", "OWNER": "TILLER", "STATUS": "SUPERSEDED", "VERSION": "1"}, versions[0].Labels)
+
+	c = NewConvert(env.Config{ConvertAll: true, TillerStorage: "local", V2ReleasePath: dir}, "", "")
+	names, err := c.v2ReleaseNames(fake.NewSimpleClientset())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"myapp", "other"}, names)
+
+	c = NewConvert(env.Config{Release: "myapp", TillerStorage: "local", V2ReleasePath: filepath.Join(dir, "other.v1")}, "", "")
+	versions, err = c.getV2Releases(fake.NewSimpleClientset())
+	require.NoError(t, err)
+	assert.Empty(t, versions, "a single file only holds the one release version")
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a release"), 0644))
+	_, err = c.getV2Releases(fake.NewSimpleClientset())
+	assert.NoError(t, err)
+	c = NewConvert(env.Config{Release: "myapp", TillerStorage: "local", V2ReleasePath: dir}, "", "")
+	_, err = c.getV2Releases(fake.NewSimpleClientset())
+	assert.Regexp(t, "^could not decode the v2 release in .*notes.txt", err)
+}
+
+func TestDryRunLocalConversion(t *testing.T) {
+	dir := localReleasesDir(t)
+	c := NewConvert(env.Config{Release: "myapp", TillerStorage: "local", V2ReleasePath: dir, DryRun: true}, "", "")
+	clientset := fake.NewSimpleClientset()
+
+	versions, err := c.getV2Releases(clientset)
+	require.NoError(t, err)
+	// a dry run doesn't need a cluster to store the releases in
+	require.NoError(t, c.doConvert(versions, clientset, common.KubeConfig{}, false))
+
+	require.Len(t, c.plans, 1)
+	assert.Equal(t, conversionPlan{
+		Release: "myapp",
+		V2Versions: []v2Version{
+			{Name: "myapp.v1", Version: 1, Status: "SUPERSEDED"},
+			{Name: "myapp.v2", Version: 2, Status: "DEPLOYED"},
+		},
+		KeptVersions: []int{1, 2},
+		V3Namespace:  "production",
+		V3Secrets:    []string{"sh.helm.release.v1.myapp.v1", "sh.helm.release.v1.myapp.v2"},
+		V2Action:     "keep",
+		V2Objects:    []string{},
+	}, c.plans[0])
+}
+
+func TestLocalConversionIsRevertedWithoutRelabelling(t *testing.T) {
+	dir := localReleasesDir(t)
+	c := NewConvert(env.Config{Release: "myapp", TillerStorage: "local", V2ReleasePath: dir}, "", "")
+	c.convertReleaseCmd = &convertCmdMock{}
+	c.clientset = fake.NewSimpleClientset()
+
+	versions, err := c.getV2Releases(c.clientset)
+	require.NoError(t, err)
+	require.NoError(t, c.doConvert(versions, c.clientset, common.KubeConfig{}, false))
+	assert.NoError(t, c.Revert(), "there are no v2 configmaps to restore")
+}
@@ -0,0 +1,165 @@
+package run
+
+import (
+	"bytes"
+	"compress/gzip"
+	ctx "context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	rspb "k8s.io/helm/pkg/proto/hapi/release"
+)
+
+// conversionPlan describes what converting a release would do, for dry runs
+type conversionPlan struct {
+	Release      string      `json:"release"`
+	V2Versions   []v2Version `json:"v2Versions"`
+	KeptVersions []int       `json:"keptVersions"`
+	V3Namespace  string      `json:"v3Namespace,omitempty"`
+	V3Secrets    []string    `json:"v3Secrets"`
+	V2Action     string      `json:"v2Action"`
+	V2Objects    []string    `json:"v2Objects"`
+	V2Label      string      `json:"v2Label,omitempty"`
+}
+
+// v2Version is one of the versions Tiller stored for a release
+type v2Version struct {
+	Name    string `json:"name"`
+	Version int    `json:"version"`
+	Status  string `json:"status"`
+}
+
+// dryRunReport is the JSON document a dry-run conversion prints and writes to convert_report_file
+type dryRunReport struct {
+	DryRun   bool             `json:"dryRun"`
+	Releases []conversionPlan `json:"releases"`
+}
+
+// planConversion works out what 2to3 and the plugin would do with the release's versions: 2to3 converts the newest
+// MaxReleaseVersions of them to v3 secrets, then either deletes the converted v2 versions or the plugin relabels all
+// of them. Local releases are left as they are.
+func (c *Convert) planConversion(versions []metav1.ObjectMeta, clientset kubernetes.Interface) conversionPlan {
+	plan := conversionPlan{Release: c.convertOptions.ReleaseName}
+	for _, meta := range versions {
+		version, _ := strconv.Atoi(meta.Labels["VERSION"])
+		plan.V2Versions = append(plan.V2Versions, v2Version{Name: meta.Name, Version: version, Status: meta.Labels["STATUS"]})
+	}
+	sort.Slice(plan.V2Versions, func(i, j int) bool { return plan.V2Versions[i].Version < plan.V2Versions[j].Version })
+
+	kept := plan.V2Versions
+	if max := c.convertOptions.MaxReleaseVersions; max > 0 && max < len(kept) {
+		kept = kept[len(kept)-max:]
+	}
+
+	plan.V3Namespace = c.v2ReleaseNamespace(clientset, plan.V2Versions[len(plan.V2Versions)-1].Name)
+	for _, version := range kept {
+		plan.KeptVersions = append(plan.KeptVersions, version.Version)
+		plan.V3Secrets = append(plan.V3Secrets, fmt.Sprintf("sh.helm.release.v1.%s.v%d", plan.Release, version.Version))
+	}
+
+	switch {
+	case c.storage == localStorage:
+		plan.V2Action = "keep"
+		plan.V2Objects = []string{}
+	case c.convertOptions.DeleteRelease:
+		plan.V2Action = "delete"
+		for _, version := range kept {
+			plan.V2Objects = append(plan.V2Objects, version.Name)
+		}
+	default:
+		plan.V2Action = "relabel"
+		plan.V2Label = c.preserveLabel
+		for _, version := range plan.V2Versions {
+			plan.V2Objects = append(plan.V2Objects, version.Name)
+		}
+	}
+	return plan
+}
+
+// v2ReleaseNamespace returns the namespace a v2 release was deployed to, which is where 2to3 stores its v3 secrets.
+// It's only recorded in the release data, so it's empty if the data can't be read.
+func (c *Convert) v2ReleaseNamespace(clientset kubernetes.Interface, name string) string {
+	if c.storage == localStorage {
+		return c.localReleaseNamespace(name)
+	}
+
+	var data string
+	tillerNamespace := c.convertOptions.TillerNamespace
+	if c.storage == secretStorage {
+		secret, err := clientset.CoreV1().Secrets(tillerNamespace).Get(ctx.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			return ""
+		}
+		data = string(secret.Data["release"])
+	} else {
+		configmap, err := clientset.CoreV1().ConfigMaps(tillerNamespace).Get(ctx.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			return ""
+		}
+		data = configmap.Data["release"]
+	}
+
+	release, err := decodeV2Release(data)
+	if err != nil {
+		return ""
+	}
+	return release.Namespace
+}
+
+// decodeV2Release decodes release data the way Tiller stores it: gzipped protobuf, base64-encoded. Releases stored
+// before Tiller compressed them aren't gzipped.
+func decodeV2Release(data string) (*rspb.Release, error) {
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(b, []byte{0x1f, 0x8b, 0x08}) {
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		if b, err = io.ReadAll(r); err != nil {
+			return nil, err
+		}
+	}
+
+	var release rspb.Release
+	if err := proto.Unmarshal(b, &release); err != nil {
+		return nil, err
+	}
+	return &release, nil
+}
+
+// printDryRunReport prints the conversion plans as JSON, and writes them to convert_report_file if it's set. When the
+// conversion is only part of another mode, there's no report unless something would have been converted.
+func (c *Convert) printDryRunReport() error {
+	if len(c.plans) == 0 && !c.reportEmpty {
+		return nil
+	}
+	report := dryRunReport{DryRun: true, Releases: c.plans}
+	if report.Releases == nil {
+		report.Releases = []conversionPlan{}
+	}
+	contents, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode the conversion report: %w", err)
+	}
+	contents = append(contents, '\n')
+
+	fmt.Fprintf(c.stdout, "Dry-run conversion report:\n%s", contents)
+	if c.reportFile == "" {
+		return nil
+	}
+	if err := os.WriteFile(c.reportFile, contents, 0644); err != nil {
+		return fmt.Errorf("could not write convert_report_file: %w", err)
+	}
+	return nil
+}
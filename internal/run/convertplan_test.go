@@ -0,0 +1,144 @@
+package run
+
+import (
+	"bytes"
+	"compress/gzip"
+	ctx "context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/helm/helm-2to3/pkg/common"
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	rspb "k8s.io/helm/pkg/proto/hapi/release"
+)
+
+// encodeV2Release stores a release the way Tiller does
+func encodeV2Release(t *testing.T, release *rspb.Release) string {
+	b, err := proto.Marshal(release)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err = w.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func clientsetWithV2HistoryMock(t *testing.T) *fake.Clientset {
+	data := encodeV2Release(t, &rspb.Release{Name: "myapp", Namespace: "production", Version: 3})
+	return fake.NewSimpleClientset(
+		&corev1.ConfigMap{ObjectMeta: v2ReleaseMeta("myapp.v3", "myapp", "3"), Data: map[string]string{"release": data}},
+		&corev1.ConfigMap{ObjectMeta: v2ReleaseMeta("myapp.v1", "myapp", "1")},
+		&corev1.ConfigMap{ObjectMeta: v2ReleaseMeta("myapp.v2", "myapp", "2")},
+	)
+}
+
+func TestDecodeV2Release(t *testing.T) {
+	release, err := decodeV2Release(encodeV2Release(t, &rspb.Release{Name: "myapp", Namespace: "production"}))
+	require.NoError(t, err)
+	assert.Equal(t, "production", release.Namespace)
+
+	_, err = decodeV2Release("")
+	assert.NoError(t, err, "empty data is an empty release")
+	_, err = decodeV2Release("H4sI")
+	assert.Error(t, err)
+}
+
+func TestPlanConversion(t *testing.T) {
+	c := NewConvert(env.Config{Release: "myapp", TillerNS: "example", MaxReleaseVersions: 2}, "", "")
+	clientset := clientsetWithV2HistoryMock(t)
+
+	versions, err := c.getV2Releases(clientset)
+	require.NoError(t, err)
+
+	assert.Equal(t, conversionPlan{
+		Release: "myapp",
+		V2Versions: []v2Version{
+			{Name: "myapp.v1", Version: 1, Status: "DEPLOYED"},
+			{Name: "myapp.v2", Version: 2, Status: "DEPLOYED"},
+			{Name: "myapp.v3", Version: 3, Status: "DEPLOYED"},
+		},
+		KeptVersions: []int{2, 3},
+		V3Namespace:  "production",
+		V3Secrets:    []string{"sh.helm.release.v1.myapp.v2", "sh.helm.release.v1.myapp.v3"},
+		V2Action:     "relabel",
+		V2Objects:    []string{"myapp.v1", "myapp.v2", "myapp.v3"},
+		V2Label:      "OWNER=converted-to-helm3",
+	}, c.planConversion(versions, clientset))
+
+	c = NewConvert(env.Config{Release: "myapp", TillerNS: "example", MaxReleaseVersions: 2, DeleteV2Releases: true}, "", "")
+	plan := c.planConversion(versions, clientset)
+	assert.Equal(t, "delete", plan.V2Action)
+	assert.Equal(t, []string{"myapp.v2", "myapp.v3"}, plan.V2Objects, "2to3 only deletes the versions it converted")
+	assert.Empty(t, plan.V2Label)
+}
+
+func TestDryRunConversionReport(t *testing.T) {
+	stdout := &strings.Builder{}
+	reportFile := filepath.Join(t.TempDir(), "convert-report.json")
+	c := NewConvert(env.Config{
+		Release:           "myapp",
+		TillerNS:          "example",
+		DryRun:            true,
+		ConvertReportFile: reportFile,
+		Stdout:            stdout,
+	}, "", "")
+	releaseMock := &convertCmdMock{}
+	c.convertReleaseCmd = releaseMock
+	clientset := clientsetWithV2HistoryMock(t)
+
+	versions, err := c.getV2Releases(clientset)
+	require.NoError(t, err)
+	require.NoError(t, c.doConvert(versions, clientset, common.KubeConfig{}, false))
+	assert.Equal(t, 1, releaseMock.Called)
+	v1, err := clientset.CoreV1().ConfigMaps("example").Get(ctx.Background(), "myapp.v1", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "TILLER", v1.Labels["OWNER"], "a dry run shouldn't relabel")
+
+	require.NoError(t, c.printDryRunReport())
+	contents, err := os.ReadFile(reportFile)
+	require.NoError(t, err)
+	assert.Equal(t, "Dry-run conversion report:\n"+string(contents), stdout.String())
+	assert.JSONEq(t, `{
+		"dryRun": true,
+		"releases": [{
+			"release": "myapp",
+			"v2Versions": [
+				{"name": "myapp.v1", "version": 1, "status": "DEPLOYED"},
+				{"name": "myapp.v2", "version": 2, "status": "DEPLOYED"},
+				{"name": "myapp.v3", "version": 3, "status": "DEPLOYED"}
+			],
+			"keptVersions": [1, 2, 3],
+			"v3Namespace": "production",
+			"v3Secrets": ["sh.helm.release.v1.myapp.v1", "sh.helm.release.v1.myapp.v2", "sh.helm.release.v1.myapp.v3"],
+			"v2Action": "relabel",
+			"v2Objects": ["myapp.v1", "myapp.v2", "myapp.v3"],
+			"v2Label": "OWNER=converted-to-helm3"
+		}]
+	}`, string(contents))
+}
+
+func TestDryRunConversionReportWithoutReleases(t *testing.T) {
+	stdout := &strings.Builder{}
+	c := NewConvert(env.Config{Command: "convert", Release: "myapp", DryRun: true, Stdout: stdout}, "", "")
+
+	require.NoError(t, c.printDryRunReport())
+	assert.Equal(t, "Dry-run conversion report:\n{\n  \"dryRun\": true,\n  \"releases\": []\n}\n", stdout.String())
+
+	stdout.Reset()
+	reportFile := filepath.Join(t.TempDir(), "report.json")
+	c = NewConvert(env.Config{Command: "upgrade", Release: "myapp", DryRun: true, ConvertReportFile: reportFile, Stdout: stdout}, "", "")
+	require.NoError(t, c.printDryRunReport())
+	assert.Empty(t, stdout.String(), "an upgrade with nothing to convert shouldn't report on the conversion")
+	assert.NoFileExists(t, reportFile)
+}
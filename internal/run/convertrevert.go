@@ -0,0 +1,139 @@
+package run
+
+import (
+	ctx "context"
+	"fmt"
+	"log"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// conversionChange records what converting a release changed, so it can be reverted
+type conversionChange struct {
+	release string
+	// namespace is where the release's helm v3 records are stored
+	namespace string
+	// v3Records are the release's helm v3 records that existed before the conversion
+	v3Records []corev1.Secret
+	// overwritten is set when convert_conflict_policy "overwrite" removed the v3 records before converting
+	overwritten bool
+	// versions are the release's v2 versions, with the labels they had before the conversion
+	versions []metav1.ObjectMeta
+	deleted  bool
+}
+
+// recordConversion notes the state of a release before it's converted
+func (c *Convert) recordConversion(clientset kubernetes.Interface, namespace string, versions []metav1.ObjectMeta) (conversionChange, error) {
+	change := conversionChange{
+		release:   c.convertOptions.ReleaseName,
+		namespace: namespace,
+		deleted:   c.convertOptions.DeleteRelease,
+	}
+	// local releases aren't touched, so there's nothing to restore
+	if c.storage != localStorage {
+		change.versions = versions
+	}
+
+	records, err := v3Records(clientset, namespace, change.release)
+	change.v3Records = records
+	return change, err
+}
+
+// v3Namespace returns the namespace 2to3 stores the release's v3 records in, which is the one its latest v2 version
+// was deployed to. If the release data can't be read, it falls back to the namespace setting.
+func (c *Convert) v3Namespace(clientset kubernetes.Interface, versions []metav1.ObjectMeta) string {
+	var latest metav1.ObjectMeta
+	latestVersion := -1
+	for _, version := range versions {
+		if number, _ := strconv.Atoi(version.Labels["VERSION"]); number > latestVersion {
+			latest, latestVersion = version, number
+		}
+	}
+
+	if namespace := c.v2ReleaseNamespace(clientset, latest.Name); namespace != "" {
+		return namespace
+	}
+	if c.namespace != "" {
+		return c.namespace
+	}
+	return metav1.NamespaceDefault
+}
+
+// v3Records lists the secrets in which helm v3 stores the release's revisions in the namespace. Release names are
+// only unique within a namespace, so a release with the same name elsewhere is a different release.
+func v3Records(clientset kubernetes.Interface, namespace, release string) ([]corev1.Secret, error) {
+	secrets, err := clientset.CoreV1().Secrets(namespace).List(ctx.Background(), metav1.ListOptions{
+		LabelSelector: "owner=helm,name=" + release,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list the v3 records of %s: %w", release, err)
+	}
+	return secrets.Items, nil
+}
+
+// Revert undoes the step's conversions when a later step fails, so the upgrade can be retried. It removes the v3
+// records that appeared after each conversion, including any from the failed upgrade, puts back any v3 records the
+// conversion overwrote, and hands the v2 versions back to Tiller by restoring their labels. A conversion that deleted the v2 versions can't be reverted, so its v3
+// records are left in place.
+func (c *Convert) Revert() error {
+	for i := len(c.changes) - 1; i >= 0; i-- {
+		if err := c.revert(c.changes[i]); err != nil {
+			return err
+		}
+	}
+	c.changes = nil
+	return nil
+}
+
+func (c *Convert) revert(change conversionChange) error {
+	if change.deleted {
+		// the v3 records are now the release's only history
+		return fmt.Errorf("the v2 release %s was deleted by the conversion, so the conversion can't be reverted", change.release)
+	}
+
+	log.Printf("Reverting the conversion of %s", change.release)
+
+	records, err := v3Records(c.clientset, change.namespace, change.release)
+	if err != nil {
+		return err
+	}
+	existed := make(map[string]bool)
+	for _, record := range change.v3Records {
+		existed[record.Name] = true
+	}
+	for _, record := range records {
+		// overwritten records were removed, so any with the same names are the conversion's
+		if existed[record.Name] && !change.overwritten {
+			continue
+		}
+		err := c.clientset.CoreV1().Secrets(record.Namespace).Delete(ctx.Background(), record.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("could not remove v3 record %s: %w", record.Name, err)
+		}
+	}
+
+	if change.overwritten {
+		for _, record := range change.v3Records {
+			restored := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        record.Name,
+					Namespace:   record.Namespace,
+					Labels:      record.Labels,
+					Annotations: record.Annotations,
+				},
+				Type: record.Type,
+				Data: record.Data,
+			}
+			_, err := c.clientset.CoreV1().Secrets(record.Namespace).Create(ctx.Background(), restored, metav1.CreateOptions{})
+			if err != nil && !apierrors.IsAlreadyExists(err) {
+				return fmt.Errorf("could not restore v3 record %s: %w", record.Name, err)
+			}
+		}
+	}
+
+	return c.restoreV2Versions(c.clientset, change.versions)
+}
@@ -0,0 +1,154 @@
+package run
+
+import (
+	ctx "context"
+	"testing"
+
+	convertcmd "github.com/helm/helm-2to3/cmd"
+	"github.com/helm/helm-2to3/pkg/common"
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// storingConvertMock stores v3 records the way 2to3 does
+type storingConvertMock struct {
+	clientset *fake.Clientset
+	revisions []string
+}
+
+func (s *storingConvertMock) ConvertRelease(convertOptions convertcmd.ConvertOptions, kubeConfig common.KubeConfig) error {
+	for _, revision := range s.revisions {
+		if _, err := s.clientset.CoreV1().Secrets("production").Create(ctx.Background(), v3Record("production", convertOptions.ReleaseName, revision), metav1.CreateOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func v3Record(namespace, release, revision string) *corev1.Secret {
+	return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Name:      "sh.helm.release.v1." + release + ".v" + revision,
+		Namespace: namespace,
+		Labels:    map[string]string{"owner": "helm", "name": release, "version": revision},
+	}}
+}
+
+func TestRevertConversion(t *testing.T) {
+	for _, storage := range []string{configmapStorage, secretStorage} {
+		t.Run(storage, func(t *testing.T) {
+			clientset := clientsetWithV2ReleasesMock(storage)
+			// a namespace-scoped service account can't list secrets in every namespace
+			clientset.PrependReactor("list", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				if action.GetNamespace() == metav1.NamespaceAll {
+					return true, nil, apierrors.NewForbidden(corev1.Resource("secrets"), "", nil)
+				}
+				return false, nil, nil
+			})
+			// a release of the same name in another namespace, which the revert should leave alone
+			_, err := clientset.CoreV1().Secrets("staging").Create(ctx.Background(), v3Record("staging", "myapp", "1"), metav1.CreateOptions{})
+			require.NoError(t, err)
+
+			c := NewConvert(env.Config{Release: "myapp", Namespace: "production", TillerNS: "example", TillerStorage: storage}, "", "")
+			c.convertReleaseCmd = &storingConvertMock{clientset: clientset, revisions: []string{"1", "2"}}
+			c.clientset = clientset
+
+			versions, err := c.getV2Releases(clientset)
+			require.NoError(t, err)
+			require.NoError(t, c.doConvert(versions, clientset, common.KubeConfig{}, false))
+			require.Equal(t, "converted-to-helm3", v2ReleaseOwner(t, clientset, storage, "myapp.v1"))
+
+			// the failed upgrade's record
+			_, err = clientset.CoreV1().Secrets("production").Create(ctx.Background(), v3Record("production", "myapp", "3"), metav1.CreateOptions{})
+			require.NoError(t, err)
+
+			require.NoError(t, c.Revert())
+
+			records, err := v3Records(clientset, "production", "myapp")
+			require.NoError(t, err)
+			assert.Empty(t, records)
+			records, err = v3Records(clientset, "staging", "myapp")
+			require.NoError(t, err)
+			assert.Len(t, records, 1)
+
+			assert.Equal(t, "TILLER", v2ReleaseOwner(t, clientset, storage, "myapp.v1"))
+			assert.Equal(t, "TILLER", v2ReleaseOwner(t, clientset, storage, "myapp.v2"))
+			restored, err := c.getV2Releases(clientset)
+			require.NoError(t, err)
+			require.Len(t, restored, 2)
+			assert.NotContains(t, restored[0].Annotations, convertedAtAnnotation)
+
+			assert.NoError(t, c.Revert(), "reverting twice should do nothing")
+		})
+	}
+}
+
+func TestRevertDeletedConversion(t *testing.T) {
+	clientset := clientsetWithV2ReleasesMock(configmapStorage)
+	c := NewConvert(env.Config{Release: "myapp", Namespace: "production", TillerNS: "example", DeleteV2Releases: true}, "", "")
+	c.convertReleaseCmd = &storingConvertMock{clientset: clientset, revisions: []string{"1", "2"}}
+	c.clientset = clientset
+
+	versions, err := c.getV2Releases(clientset)
+	require.NoError(t, err)
+	require.NoError(t, c.doConvert(versions, clientset, common.KubeConfig{}, false))
+
+	assert.EqualError(t, c.Revert(), "the v2 release myapp was deleted by the conversion, so the conversion can't be reverted")
+	records, err := v3Records(clientset, "production", "myapp")
+	require.NoError(t, err)
+	assert.Len(t, records, 2, "the v3 records are all that's left of the release, so they should be kept")
+}
+
+func TestRevertOverwrittenConversion(t *testing.T) {
+	clientset := clientsetWithV2ReleasesMock(configmapStorage)
+	old := v3Record("production", "myapp", "1")
+	old.Data = map[string][]byte{"release": []byte("old")}
+	_, err := clientset.CoreV1().Secrets("production").Create(ctx.Background(), old, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	c := NewConvert(env.Config{Release: "myapp", Namespace: "production", TillerNS: "example", ConvertConflictPolicy: conflictOverwrite}, "", "")
+	c.convertReleaseCmd = &storingConvertMock{clientset: clientset, revisions: []string{"1", "2"}}
+	c.clientset = clientset
+
+	versions, err := c.getV2Releases(clientset)
+	require.NoError(t, err)
+	require.NoError(t, c.doConvert(versions, clientset, common.KubeConfig{}, true))
+	records, err := v3Records(clientset, "production", "myapp")
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+
+	require.NoError(t, c.Revert())
+
+	records, err = v3Records(clientset, "production", "myapp")
+	require.NoError(t, err)
+	require.Len(t, records, 1, "only the overwritten record should be left")
+	assert.Equal(t, []byte("old"), records[0].Data["release"])
+	assert.Equal(t, "TILLER", v2ReleaseOwner(t, clientset, configmapStorage, "myapp.v1"))
+}
+
+func TestV3Namespace(t *testing.T) {
+	c := NewConvert(env.Config{Release: "myapp", Namespace: "other", TillerNS: "example"}, "", "")
+	clientset := clientsetWithV2HistoryMock(t)
+	versions, err := c.getV2Releases(clientset)
+	require.NoError(t, err)
+	assert.Equal(t, "production", c.v3Namespace(clientset, versions), "the latest v2 version's namespace should be used")
+
+	clientset = clientsetWithV2ReleasesMock(configmapStorage)
+	versions, err = c.getV2Releases(clientset)
+	require.NoError(t, err)
+	assert.Equal(t, "other", c.v3Namespace(clientset, versions), "unreadable release data should fall back to the namespace setting")
+
+	c = NewConvert(env.Config{Release: "myapp", TillerNS: "example"}, "", "")
+	assert.Equal(t, "default", c.v3Namespace(clientset, versions))
+}
+
+func TestRevertWithoutConversion(t *testing.T) {
+	c := NewConvert(env.Config{Release: "myapp"}, "", "")
+	assert.NoError(t, c.Revert())
+}
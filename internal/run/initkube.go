@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"github.com/mongodb-forks/drone-helm3/internal/env"
 	"io"
+	"net/url"
 	"os"
+	"path/filepath"
 	"text/template"
 )
 
@@ -20,12 +22,15 @@ type InitKube struct {
 }
 
 type kubeValues struct {
-	SkipTLSVerify  bool
-	Certificate    string
-	APIServer      string
-	Namespace      string
-	ServiceAccount string
-	Token          string
+	SkipTLSVerify   bool
+	Certificate     string
+	CertificateFile string
+	APIServer       string
+	ProxyURL        string
+	TLSServerName   string
+	Namespace       string
+	ServiceAccount  string
+	Token           string
 }
 
 // NewInitKube creates a InitKube using the given Config and filepaths. No validation is performed at this time.
@@ -33,12 +38,15 @@ func NewInitKube(cfg env.Config, templateFile, configFile string) *InitKube {
 	return &InitKube{
 		config: newConfig(cfg),
 		values: kubeValues{
-			SkipTLSVerify:  cfg.SkipTLSVerify,
-			Certificate:    cfg.Certificate,
-			APIServer:      cfg.APIServer,
-			Namespace:      cfg.Namespace,
-			ServiceAccount: cfg.ServiceAccount,
-			Token:          cfg.KubeToken,
+			SkipTLSVerify:   cfg.SkipTLSVerify,
+			Certificate:     cfg.Certificate,
+			CertificateFile: cfg.CertificateFile,
+			APIServer:       cfg.APIServer,
+			ProxyURL:        cfg.ProxyURL,
+			TLSServerName:   cfg.TLSServerName,
+			Namespace:       cfg.Namespace,
+			ServiceAccount:  cfg.ServiceAccount,
+			Token:           cfg.KubeToken,
 		},
 		templateFilename: templateFile,
 		configFilename:   configFile,
@@ -64,6 +72,16 @@ func (i *InitKube) Prepare() error {
 	if i.values.Token == "" {
 		return errors.New("token is needed to deploy")
 	}
+	if i.values.ProxyURL != "" {
+		if _, err := url.Parse(i.values.ProxyURL); err != nil {
+			return fmt.Errorf("invalid kube_proxy_url: %w", err)
+		}
+	}
+	if i.values.CertificateFile != "" {
+		if _, err := os.Stat(i.values.CertificateFile); err != nil {
+			return fmt.Errorf("could not read kube_certificate_file: %w", err)
+		}
+	}
 
 	if i.values.ServiceAccount == "" {
 		i.values.ServiceAccount = "helm"
@@ -87,9 +105,17 @@ func (i *InitKube) Prepare() error {
 		fmt.Fprintf(i.stderr, "kubeconfig file at %s\n", i.configFilename)
 	}
 
-	i.configFile, err = os.Create(i.configFilename)
+	// the kubeconfig contains credentials, so it should only be readable by the current user
+	// the default location is a .kube directory that may not exist yet; if it can't be made, opening the file fails
+	_ = os.Mkdir(filepath.Dir(i.configFilename), 0700)
+	configFile, err := os.OpenFile(i.configFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return fmt.Errorf("could not open kubeconfig file for writing: %w", err)
 	}
+	if err := configFile.Chmod(0600); err != nil {
+		configFile.Close()
+		return fmt.Errorf("could not set kubeconfig file permissions: %w", err)
+	}
+	i.configFile = configFile
 	return nil
 }
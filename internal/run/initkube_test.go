@@ -3,6 +3,7 @@ package run
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"text/template"
@@ -22,22 +23,28 @@ func TestInitKubeTestSuite(t *testing.T) {
 
 func (suite *InitKubeTestSuite) TestNewInitKube() {
 	cfg := env.Config{
-		SkipTLSVerify:  true,
-		Certificate:    "cHJvY2xhaW1zIHdvbmRlcmZ1bCBmcmllbmRzaGlw",
-		APIServer:      "98.765.43.21",
-		ServiceAccount: "greathelm",
-		KubeToken:      "b2YgbXkgYWZmZWN0aW9u",
-		Stderr:         &strings.Builder{},
-		Debug:          true,
+		SkipTLSVerify:   true,
+		Certificate:     "cHJvY2xhaW1zIHdvbmRlcmZ1bCBmcmllbmRzaGlw",
+		CertificateFile: "/etc/ssl/friendship.pem",
+		APIServer:       "98.765.43.21",
+		ProxyURL:        "http://12.345.67.89:3128",
+		TLSServerName:   "kube.greathelm",
+		ServiceAccount:  "greathelm",
+		KubeToken:       "b2YgbXkgYWZmZWN0aW9u",
+		Stderr:          &strings.Builder{},
+		Debug:           true,
 	}
 
 	init := NewInitKube(cfg, "conf.tpl", "conf.yml")
 	suite.Equal(kubeValues{
-		SkipTLSVerify:  true,
-		Certificate:    "cHJvY2xhaW1zIHdvbmRlcmZ1bCBmcmllbmRzaGlw",
-		APIServer:      "98.765.43.21",
-		ServiceAccount: "greathelm",
-		Token:          "b2YgbXkgYWZmZWN0aW9u",
+		SkipTLSVerify:   true,
+		Certificate:     "cHJvY2xhaW1zIHdvbmRlcmZ1bCBmcmllbmRzaGlw",
+		CertificateFile: "/etc/ssl/friendship.pem",
+		APIServer:       "98.765.43.21",
+		ProxyURL:        "http://12.345.67.89:3128",
+		TLSServerName:   "kube.greathelm",
+		ServiceAccount:  "greathelm",
+		Token:           "b2YgbXkgYWZmZWN0aW9u",
 	}, init.values)
 	suite.Equal("conf.tpl", init.templateFilename)
 	suite.Equal("conf.yml", init.configFilename)
@@ -55,6 +62,8 @@ namespace: {{ .Namespace }}
 	configFile, err := tempfile("kubeconfig********.yml", "")
 	defer os.Remove(configFile.Name())
 	suite.Require().Nil(err)
+	// an existing kubeconfig should be made private, too
+	suite.Require().NoError(os.Chmod(configFile.Name(), 0644))
 
 	cfg := env.Config{
 		APIServer:   "Sysadmin",
@@ -80,6 +89,33 @@ certificate: CCNA
 namespace: Cisco
 `
 	suite.Equal(want, string(conf))
+
+	info, err := os.Stat(configFile.Name())
+	suite.Require().NoError(err)
+	suite.Equal(os.FileMode(0600), info.Mode().Perm())
+}
+
+func (suite *InitKubeTestSuite) TestPrepareCreatesPrivateConfigFile() {
+	templateFile, err := tempfile("kubeconfig********.yml.tpl", "hurgity burgity")
+	defer os.Remove(templateFile.Name())
+	suite.Require().Nil(err)
+
+	// the default location's .kube directory may not exist yet
+	configFilename := filepath.Join(suite.T().TempDir(), ".kube", "config")
+	cfg := env.Config{
+		APIServer: "Sysadmin",
+		KubeToken: "Aspire virtual currency",
+	}
+	init := NewInitKube(cfg, templateFile.Name(), configFilename)
+	suite.Require().NoError(init.Prepare())
+	suite.Require().NoError(init.Execute())
+
+	info, err := os.Stat(configFilename)
+	suite.Require().NoError(err)
+	suite.Equal(os.FileMode(0600), info.Mode().Perm())
+	info, err = os.Stat(filepath.Dir(configFilename))
+	suite.Require().NoError(err)
+	suite.Equal(os.FileMode(0700), info.Mode().Perm())
 }
 
 func (suite *InitKubeTestSuite) TestExecuteGeneratesConfig() {
@@ -130,6 +166,43 @@ func (suite *InitKubeTestSuite) TestExecuteGeneratesConfig() {
 
 	conf = map[string]interface{}{}
 	suite.NoError(yaml.UnmarshalStrict(contents, &conf))
+
+	// a CA file, server name and proxy should all be reflected too
+	caFile, err := tempfile("cluster-ca********.pem", "smoke signals")
+	defer os.Remove(caFile.Name())
+	suite.Require().NoError(err)
+
+	init.values.SkipTLSVerify = false
+	init.values.CertificateFile = caFile.Name()
+	init.values.TLSServerName = "kube.campfire"
+	init.values.ProxyURL = "http://proxy.campfire:3128"
+
+	suite.Require().NoError(init.Prepare())
+	suite.Require().NoError(init.Execute())
+	contents, err = os.ReadFile(configFile.Name())
+	suite.Require().NoError(err)
+	suite.Contains(string(contents), fmt.Sprintf("certificate-authority: %s", caFile.Name()))
+	suite.Contains(string(contents), "tls-server-name: kube.campfire")
+	suite.Contains(string(contents), "proxy-url: http://proxy.campfire:3128")
+
+	conf = map[string]interface{}{}
+	suite.NoError(yaml.UnmarshalStrict(contents, &conf))
+}
+
+func (suite *InitKubeTestSuite) TestPrepareNonexistentCertificateFile() {
+	templateFile, err := tempfile("kubeconfig********.yml.tpl", "hurgity burgity")
+	defer os.Remove(templateFile.Name())
+	suite.Require().Nil(err)
+
+	cfg := env.Config{
+		APIServer:       "Sysadmin",
+		CertificateFile: "/usr/foreign/exclude/ca.pem",
+		KubeToken:       "Aspire virtual currency",
+	}
+	init := NewInitKube(cfg, templateFile.Name(), "")
+	err = init.Prepare()
+	suite.Error(err)
+	suite.Regexp("could not read kube_certificate_file: .* no such file or directory", err)
 }
 
 func (suite *InitKubeTestSuite) TestPrepareParseError() {
@@ -2,35 +2,101 @@ package run
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
 	"github.com/mongodb-forks/drone-helm3/internal/env"
 )
 
-// Lint is an execution step that calls `helm lint` when executed.
+// Lint is an execution step that calls `helm lint` when executed. It lints every chart in the chart setting with
+// every set of values files in lint_matrix, and with validate_schemas, checks the resources each of them renders.
 type Lint struct {
 	*config
-	chart        string
-	values       string
-	stringValues string
-	valuesFiles  []string
-	strict       bool
-	cmd          cmd
+	chart       string
+	matrix      [][]string
+	setValues   *setValues
+	valuesFiles *valuesFiles
+	strict      bool
+	validator   *schemaValidator
+	sets        []*valuesFiles
+	runs        []*lintRun
+}
+
+// lintRun is one `helm lint` of a chart with one set of values files, which it shares with the other charts' runs
+type lintRun struct {
+	chart       string
+	values      []string
+	valuesFiles *valuesFiles
+	cmd         cmd
+	template    cmd
 }
 
 // NewLint creates a Lint using fields from the given Config. No validation is performed at this time.
 func NewLint(cfg env.Config) *Lint {
 	return &Lint{
-		config:       newConfig(cfg),
-		chart:        cfg.Chart,
-		values:       cfg.Values,
-		stringValues: cfg.StringValues,
-		valuesFiles:  cfg.ValuesFiles,
-		strict:       cfg.LintStrictly,
+		config:      newConfig(cfg),
+		chart:       cfg.Chart,
+		matrix:      cfg.LintMatrix,
+		setValues:   newSetValues(cfg),
+		valuesFiles: newValuesFiles(cfg),
+		strict:      cfg.LintStrictly,
+		validator:   newSchemaValidator(cfg),
 	}
 }
 
-// Execute executes the `helm lint` command.
+// Execute executes the `helm lint` commands. When there's more than one, they all run, even if some fail, and their
+// results are printed as a table.
 func (l *Lint) Execute() error {
-	return l.cmd.Run()
+	if len(l.runs) == 1 {
+		return l.execute(l.runs[0])
+	}
+
+	results := make([]error, len(l.runs))
+	failed := 0
+	for i, run := range l.runs {
+		fmt.Fprintf(l.stdout, "Linting %s with values %s\n", run.chart, run.describeValues())
+		if results[i] = l.execute(run); results[i] != nil {
+			failed++
+		}
+	}
+
+	l.printResults(results)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d lint runs failed", failed, len(l.runs))
+	}
+	return nil
+}
+
+// execute lints one chart and values combination, then validates what it renders against the schemas, even if
+// linting failed, so both kinds of problem are reported
+func (l *Lint) execute(run *lintRun) error {
+	err := run.cmd.Run()
+	if run.template == nil {
+		return err
+	}
+
+	manifest, renderErr := run.template.Output()
+	if renderErr != nil {
+		renderErr = fmt.Errorf("while rendering chart: %w", renderErr)
+	} else {
+		renderErr = l.validator.validate(run.chart, string(manifest), l.stderr)
+	}
+	if err == nil {
+		err = renderErr
+	}
+	return err
+}
+
+// Cleanup removes any temporary values files.
+func (l *Lint) Cleanup() error {
+	for _, set := range append([]*valuesFiles{l.valuesFiles}, l.sets...) {
+		if err := set.cleanup(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Prepare gets the Lint ready to execute.
@@ -39,31 +105,140 @@ func (l *Lint) Prepare() error {
 		return fmt.Errorf("chart is required")
 	}
 
-	args := l.globalFlags()
-	args = append(args, "lint")
+	if err := l.validator.prepare(); err != nil {
+		return err
+	}
+
+	charts, err := LintCharts(l.chart)
+	if err != nil {
+		return err
+	}
+	matrix := l.matrix
+	if len(matrix) == 0 {
+		matrix = [][]string{nil}
+	}
 
-	if l.values != "" {
-		args = append(args, "--set", l.values)
+	// the values files are decrypted and resolved once, however many charts use them
+	if err := l.valuesFiles.write(); err != nil {
+		return err
 	}
-	if l.stringValues != "" {
-		args = append(args, "--set-string", l.stringValues)
+	l.sets = nil
+	for _, files := range matrix {
+		set := l.valuesFiles.only(files)
+		l.sets = append(l.sets, set)
+		if err := set.write(); err != nil {
+			return err
+		}
 	}
-	for _, vFile := range l.valuesFiles {
-		args = append(args, "--values", vFile)
+
+	l.runs = nil
+	for _, chart := range charts {
+		for i, set := range l.sets {
+			run := &lintRun{chart: chart, values: matrix[i], valuesFiles: set}
+			l.runs = append(l.runs, run)
+			l.prepareRun(run)
+		}
 	}
+
+	return nil
+}
+
+func (l *Lint) prepareRun(run *lintRun) {
+	valuesFlags := append(l.valuesFiles.flags(), run.valuesFiles.flags()...)
+
+	args := l.globalFlags()
+	args = append(args, "lint")
+
+	args = append(args, l.setValues.flags()...)
+	args = append(args, valuesFlags...)
 	if l.strict {
 		args = append(args, "--strict")
 	}
 
-	args = append(args, l.chart)
+	args = append(args, run.chart)
 
-	l.cmd = command(helmBin, args...)
-	l.cmd.Stdout(l.stdout)
-	l.cmd.Stderr(l.stderr)
+	run.cmd = command(helmBin, args...)
+	run.cmd.Stdout(l.stdout)
+	run.cmd.Stderr(l.stderr)
 
 	if l.debug {
-		fmt.Fprintf(l.stderr, "Generated command: '%s'\n", l.cmd.String())
+		fmt.Fprintf(l.stderr, "Generated command: '%s'\n", run.cmd.String())
 	}
 
-	return nil
+	if l.validator != nil {
+		args := l.globalFlags()
+		args = append(args, "template", "--kube-version", l.validator.kubeVersion)
+		args = append(args, l.setValues.flags()...)
+		args = append(args, valuesFlags...)
+		args = append(args, run.chart)
+
+		run.template = command(helmBin, args...)
+		run.template.Stderr(l.stderr)
+
+		if l.debug {
+			fmt.Fprintf(l.stderr, "Generated command: '%s'\n", run.template.String())
+		}
+	}
+}
+
+// LintCharts expands lint mode's chart setting, a comma-separated list of charts and glob patterns. Patterns match
+// chart directories and packaged charts, not other files.
+func LintCharts(chart string) ([]string, error) {
+	var charts []string
+	for _, entry := range strings.Split(chart, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.ContainsAny(entry, "*?[") {
+			charts = append(charts, entry)
+			continue
+		}
+
+		matches, err := filepath.Glob(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chart pattern '%s': %w", entry, err)
+		}
+		found := false
+		for _, match := range matches {
+			if isChart(match) {
+				charts = append(charts, match)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("chart pattern '%s' doesn't match any charts", entry)
+		}
+	}
+	return charts, nil
+}
+
+// isChart reports whether the path is a chart directory or a packaged chart
+func isChart(path string) bool {
+	if strings.HasSuffix(path, ".tgz") {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(path, "Chart.yaml"))
+	return err == nil
+}
+
+func (l *Lint) printResults(results []error) {
+	fmt.Fprintf(l.stdout, "Lint results:\n")
+	table := tabwriter.NewWriter(l.stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintf(table, "  CHART\tVALUES\tRESULT\n")
+	for i, run := range l.runs {
+		result := "pass"
+		if results[i] != nil {
+			result = "FAIL"
+		}
+		fmt.Fprintf(table, "  %s\t%s\t%s\n", run.chart, run.describeValues(), result)
+	}
+	table.Flush()
+}
+
+func (run *lintRun) describeValues() string {
+	if len(run.values) == 0 {
+		return "-"
+	}
+	return strings.Join(run.values, ", ")
 }
@@ -1,11 +1,16 @@
 package run
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/golang/mock/gomock"
 	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -35,17 +40,17 @@ func TestLintTestSuite(t *testing.T) {
 func (suite *LintTestSuite) TestNewLint() {
 	cfg := env.Config{
 		Chart:        "./flow",
-		Values:       "steadfastness,forthrightness",
-		StringValues: "tensile_strength,flexibility",
+		Values:       env.ValueList{"steadfastness,forthrightness"},
+		StringValues: env.ValueList{"tensile_strength,flexibility"},
 		ValuesFiles:  []string{"/root/price_inventory.yml"},
 		LintStrictly: true,
 	}
 	lint := NewLint(cfg)
 	suite.Require().NotNil(lint)
 	suite.Equal("./flow", lint.chart)
-	suite.Equal("steadfastness,forthrightness", lint.values)
-	suite.Equal("tensile_strength,flexibility", lint.stringValues)
-	suite.Equal([]string{"/root/price_inventory.yml"}, lint.valuesFiles)
+	suite.Equal([]string{"steadfastness,forthrightness"}, lint.setValues.values)
+	suite.Equal([]string{"tensile_strength,flexibility"}, lint.setValues.stringValues)
+	suite.Equal([]string{"/root/price_inventory.yml"}, lint.valuesFiles.files)
 	suite.Equal(true, lint.strict)
 	suite.NotNil(lint.config)
 }
@@ -100,8 +105,8 @@ func (suite *LintTestSuite) TestPrepareWithLintFlags() {
 
 	cfg := env.Config{
 		Chart:        "./uk/top_40",
-		Values:       "width=5",
-		StringValues: "version=2.0",
+		Values:       env.ValueList{"width=5"},
+		StringValues: env.ValueList{"version=2.0"},
 		ValuesFiles:  []string{"/usr/local/underrides", "/usr/local/overrides"},
 		LintStrictly: true,
 	}
@@ -127,3 +132,140 @@ func (suite *LintTestSuite) TestPrepareWithLintFlags() {
 	err := l.Prepare()
 	suite.Require().Nil(err)
 }
+
+// chartsDir creates a directory with two charts, a packaged chart, and a file that isn't a chart
+func chartsDir(t *testing.T) string {
+	dir := t.TempDir()
+	for _, chart := range []string{"api", "web"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, chart), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, chart, "Chart.yaml"), []byte("name: "+chart), 0644))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "worker-1.0.0.tgz"), nil, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README.md"), nil, 0644))
+	return dir
+}
+
+func (suite *LintTestSuite) TestPrepareExpandsCharts() {
+	dir := chartsDir(suite.T())
+
+	charts, err := LintCharts(filepath.Join(dir, "*") + ", stable/nginx")
+	suite.Require().NoError(err)
+	suite.Equal([]string{filepath.Join(dir, "api"), filepath.Join(dir, "web"), filepath.Join(dir, "worker-1.0.0.tgz"), "stable/nginx"}, charts)
+
+	l := NewLint(env.Config{Chart: filepath.Join(dir, "*.md")})
+	suite.EqualError(l.Prepare(), fmt.Sprintf("chart pattern '%s' doesn't match any charts", filepath.Join(dir, "*.md")))
+}
+
+func (suite *LintTestSuite) TestExecuteMatrix() {
+	defer suite.ctrl.Finish()
+	dir := chartsDir(suite.T())
+
+	stdout := &strings.Builder{}
+	cfg := env.Config{
+		Chart:       filepath.Join(dir, "api") + "," + filepath.Join(dir, "web"),
+		ValuesFiles: []string{"values.yaml"},
+		LintMatrix:  env.LintMatrix{{"values-prod.yaml"}, {"values-staging.yaml", "secrets.yaml"}},
+		Stdout:      stdout,
+	}
+	l := NewLint(cfg)
+
+	var commands [][]string
+	command = func(path string, args ...string) cmd {
+		commands = append(commands, args)
+		run := NewMockcmd(suite.ctrl)
+		run.EXPECT().Stdout(gomock.Any())
+		run.EXPECT().Stderr(gomock.Any())
+		if len(commands) == 2 {
+			run.EXPECT().Run().Return(errors.New("exit status 1"))
+		} else {
+			run.EXPECT().Run()
+		}
+		return run
+	}
+
+	suite.Require().NoError(l.Prepare())
+	suite.Equal([][]string{
+		{"lint", "--values", "values.yaml", "--values", "values-prod.yaml", filepath.Join(dir, "api")},
+		{"lint", "--values", "values.yaml", "--values", "values-staging.yaml", "--values", "secrets.yaml", filepath.Join(dir, "api")},
+		{"lint", "--values", "values.yaml", "--values", "values-prod.yaml", filepath.Join(dir, "web")},
+		{"lint", "--values", "values.yaml", "--values", "values-staging.yaml", "--values", "secrets.yaml", filepath.Join(dir, "web")},
+	}, commands)
+
+	suite.EqualError(l.Execute(), "1 of 4 lint runs failed", "every run should happen before the step fails")
+	api, web := filepath.Join(dir, "api"), filepath.Join(dir, "web")
+	suite.Contains(stdout.String(), "Linting "+api+" with values values-staging.yaml, secrets.yaml\n")
+	suite.Contains(stdout.String(), "Lint results:\n"+
+		"  CHART"+strings.Repeat(" ", len(api)-2)+"VALUES                              RESULT\n"+
+		"  "+api+"   values-prod.yaml                    pass\n"+
+		"  "+api+"   values-staging.yaml, secrets.yaml   FAIL\n"+
+		"  "+web+"   values-prod.yaml                    pass\n"+
+		"  "+web+"   values-staging.yaml, secrets.yaml   pass\n")
+}
+
+func (suite *LintTestSuite) TestPrepareDecryptsValuesFilesOnce() {
+	defer suite.ctrl.Finish()
+	dir := chartsDir(suite.T())
+
+	cfg := env.Config{
+		Chart:       filepath.Join(dir, "api") + "," + filepath.Join(dir, "web"),
+		ValuesFiles: []string{"sops:secrets.enc.yaml"},
+		LintMatrix:  env.LintMatrix{{"values-prod.yaml"}, {"sops:staging.enc.yaml"}},
+	}
+	l := NewLint(cfg)
+
+	decrypted := map[string]int{}
+	var lints [][]string
+	command = func(path string, args ...string) cmd {
+		run := NewMockcmd(suite.ctrl)
+		if path == sopsBin {
+			decrypted[args[len(args)-1]]++
+			run.EXPECT().Stderr(gomock.Any())
+			run.EXPECT().Output().Return([]byte("password: hunter2\n"), nil)
+			return run
+		}
+		lints = append(lints, args)
+		run.EXPECT().Stdout(gomock.Any())
+		run.EXPECT().Stderr(gomock.Any())
+		return run
+	}
+
+	suite.Require().NoError(l.Prepare())
+	suite.Equal(map[string]int{"secrets.enc.yaml": 1, "staging.enc.yaml": 1}, decrypted,
+		"each values file should be decrypted once, however many charts use it")
+	suite.Require().Len(lints, 4)
+	suite.Equal(lints[0][:3], lints[2][:3], "the charts should share the decrypted values file")
+	suite.Equal(lints[1][:5], lints[3][:5])
+
+	suite.Require().NoError(l.Cleanup())
+	for _, file := range []string{lints[0][2], lints[1][4]} {
+		_, err := os.Stat(file)
+		suite.True(os.IsNotExist(err), "cleanup should remove %s", file)
+	}
+}
+
+func (suite *LintTestSuite) TestExecuteValidatesSchemas() {
+	defer suite.ctrl.Finish()
+	location, chart := schemaFixtures(suite.T())
+
+	stderr := &strings.Builder{}
+	l := NewLint(env.Config{Chart: chart, ValidateSchemas: true, SchemaLocation: location, Stderr: stderr})
+
+	lint, template := NewMockcmd(suite.ctrl), NewMockcmd(suite.ctrl)
+	command = func(path string, args ...string) cmd {
+		if args[0] == "template" {
+			suite.Equal([]string{"template", "--kube-version", "1.27.0", chart}, args)
+			return template
+		}
+		return lint
+	}
+	lint.EXPECT().Stdout(gomock.Any())
+	lint.EXPECT().Stderr(gomock.Any())
+	lint.EXPECT().Run().Return(errors.New("exit status 1"))
+	template.EXPECT().Stderr(gomock.Any())
+	template.EXPECT().Output().Return([]byte("apiVersion: example.com/v1\nkind: Widget\nmetadata:\n  name: gear\nspec:\n  size: big\n"), nil)
+
+	suite.Require().NoError(l.Prepare())
+	suite.EqualError(l.Execute(), "exit status 1")
+	suite.Contains(stderr.String(), "  Widget/gear: spec.size: Invalid type. Expected: integer, given: string\n",
+		"schema errors should be reported even when linting fails")
+}
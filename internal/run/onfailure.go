@@ -0,0 +1,292 @@
+package run
+
+import (
+	ctx "context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+const (
+	diagnoseOnFailure = "diagnose"
+	rollbackOnFailure = "rollback"
+)
+
+// failureHandler explains, and optionally undoes, a failed `helm upgrade`, for the on_failure setting.
+type failureHandler struct {
+	*config
+	release   string
+	actions   []string
+	atomic    bool
+	diagnose  bool
+	rollback  bool
+	logLines  int64
+	wait      bool
+	timeout   string
+	cluster   clientcmdapi.Cluster
+	clientset kubernetes.Interface
+}
+
+func newFailureHandler(cfg env.Config) *failureHandler {
+	if len(cfg.OnFailure) == 0 || cfg.DryRun {
+		return nil
+	}
+	return &failureHandler{
+		config:   newConfig(cfg),
+		release:  cfg.Release,
+		actions:  cfg.OnFailure,
+		atomic:   cfg.AtomicUpgrade,
+		logLines: int64(cfg.FailureLogLines),
+		wait:     cfg.Wait,
+		timeout:  cfg.Timeout,
+		cluster:  kubeCluster(cfg),
+	}
+}
+
+// prepare checks the on_failure actions. Rolling back isn't allowed along with --atomic, since helm will already have
+// rolled back by the time the plugin sees the failure.
+func (h *failureHandler) prepare() error {
+	if h == nil {
+		return nil
+	}
+	for _, action := range h.actions {
+		switch strings.TrimSpace(action) {
+		case diagnoseOnFailure:
+			h.diagnose = true
+		case rollbackOnFailure:
+			h.rollback = true
+		default:
+			return fmt.Errorf("unknown on_failure action '%s': must be '%s' or '%s'", action, diagnoseOnFailure, rollbackOnFailure)
+		}
+	}
+	if h.rollback && h.atomic {
+		return fmt.Errorf("on_failure can't roll back when atomic_upgrade is set, since helm already rolls back atomic upgrades")
+	}
+	return nil
+}
+
+// handle runs the on_failure actions for the upgrade error err. Problems gathering diagnostics are only reported, so
+// they don't hide the upgrade's error, but a failed rollback is returned along with it.
+func (h *failureHandler) handle(err error) error {
+	if h.clientset == nil {
+		clientset, cErr := clientsetFromFile(h.kubeConfig, h.cluster)
+		if cErr != nil {
+			fmt.Fprintf(h.stderr, "Warning: can't connect to the cluster to handle the failed upgrade: %s\n", cErr)
+			return err
+		}
+		h.clientset = clientset
+	}
+
+	if h.diagnose {
+		if dErr := h.printDiagnostics(); dErr != nil {
+			fmt.Fprintf(h.stderr, "Warning: could not gather diagnostics: %s\n", dErr)
+		}
+	}
+	if h.rollback {
+		if rErr := h.rollBack(); rErr != nil {
+			return fmt.Errorf("%w; rollback also failed: %v", err, rErr)
+		}
+	}
+	return err
+}
+
+func (h *failureHandler) ns() string {
+	if h.namespace == "" {
+		return metav1.NamespaceDefault
+	}
+	return h.namespace
+}
+
+// printDiagnostics prints the warning events, pod statuses and recent logs of the release's resources, grouped by
+// resource. Pods are found through the labels helm's chart starter uses, and other resources by helm's convention of
+// prefixing their names with the release name.
+func (h *failureHandler) printDiagnostics() error {
+	pods, err := h.releasePods()
+	if err != nil {
+		return err
+	}
+	events, err := h.clientset.CoreV1().Events(h.ns()).List(ctx.Background(), metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list events: %w", err)
+	}
+
+	podNames := make(map[string]bool)
+	details := make(map[string][]string)
+	for _, pod := range pods {
+		podNames[pod.Name] = true
+		details["Pod/"+pod.Name] = append(details["Pod/"+pod.Name], h.podDetails(pod)...)
+	}
+	for _, event := range events.Items {
+		object := event.InvolvedObject
+		if event.Type != corev1.EventTypeWarning {
+			continue
+		}
+		if !(object.Kind == "Pod" && podNames[object.Name]) && !strings.HasPrefix(object.Name, h.release) {
+			continue
+		}
+		line := fmt.Sprintf("event: %s: %s", event.Reason, strings.TrimSpace(event.Message))
+		if event.Count > 1 {
+			line += fmt.Sprintf(" (x%d)", event.Count)
+		}
+		key := object.Kind + "/" + object.Name
+		details[key] = append(details[key], line)
+	}
+
+	resources := make([]string, 0, len(details))
+	for resource, lines := range details {
+		if len(lines) > 0 {
+			resources = append(resources, resource)
+		}
+	}
+	sort.Strings(resources)
+
+	fmt.Fprintf(h.stderr, "Diagnostics for release %s in namespace %s:\n", h.release, h.ns())
+	if len(resources) == 0 {
+		fmt.Fprintf(h.stderr, "  no failing pods or warning events found\n")
+	}
+	for _, resource := range resources {
+		fmt.Fprintf(h.stderr, "%s:\n", resource)
+		for _, line := range details[resource] {
+			fmt.Fprintf(h.stderr, "  %s\n", line)
+		}
+	}
+	return nil
+}
+
+func (h *failureHandler) releasePods() ([]corev1.Pod, error) {
+	for _, selector := range []string{"app.kubernetes.io/instance=" + h.release, "release=" + h.release} {
+		pods, err := h.clientset.CoreV1().Pods(h.ns()).List(ctx.Background(), metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return nil, fmt.Errorf("could not list pods: %w", err)
+		}
+		if len(pods.Items) > 0 {
+			return pods.Items, nil
+		}
+	}
+	return nil, nil
+}
+
+// podDetails describes what's wrong with a pod, if anything, including the logs of its crashing containers.
+func (h *failureHandler) podDetails(pod corev1.Pod) []string {
+	var lines []string
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodScheduled && condition.Status == corev1.ConditionFalse {
+			lines = append(lines, fmt.Sprintf("status: %s, not scheduled: %s", pod.Status.Phase, condition.Message))
+		}
+	}
+	for _, container := range pod.Status.ContainerStatuses {
+		state := container.State
+		switch {
+		case state.Waiting != nil:
+			lines = append(lines, fmt.Sprintf("status: %s, container %s is waiting: %s %s",
+				pod.Status.Phase, container.Name, state.Waiting.Reason, state.Waiting.Message))
+		case state.Terminated != nil && state.Terminated.ExitCode != 0:
+			lines = append(lines, fmt.Sprintf("status: %s, container %s exited with code %d: %s",
+				pod.Status.Phase, container.Name, state.Terminated.ExitCode, state.Terminated.Reason))
+		case !container.Ready:
+			lines = append(lines, fmt.Sprintf("status: %s, container %s is not ready", pod.Status.Phase, container.Name))
+		default:
+			continue
+		}
+		if container.RestartCount > 0 || state.Terminated != nil {
+			lines = append(lines, h.containerLogs(pod, container)...)
+		}
+	}
+	return lines
+}
+
+func (h *failureHandler) containerLogs(pod corev1.Pod, container corev1.ContainerStatus) []string {
+	if h.logLines <= 0 {
+		return nil
+	}
+	// a restarted container's own logs are usually empty, so show the logs of the run that crashed
+	options := &corev1.PodLogOptions{
+		Container: container.Name,
+		TailLines: &h.logLines,
+		Previous:  container.RestartCount > 0,
+	}
+	logs, err := h.clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, options).DoRaw(ctx.Background())
+	if err != nil {
+		return []string{fmt.Sprintf("could not get logs of container %s: %s", container.Name, err)}
+	}
+
+	lines := []string{fmt.Sprintf("last %d log lines of container %s:", h.logLines, container.Name)}
+	for _, line := range strings.Split(strings.TrimRight(string(logs), "\n"), "\n") {
+		lines = append(lines, "  "+line)
+	}
+	return lines
+}
+
+// rollBack calls `helm rollback` with the release's last successfully deployed revision. helm's own default is the
+// revision before the current one, which is wrong when the upgrade failed before it recorded a revision.
+func (h *failureHandler) rollBack() error {
+	current, previous, err := h.revisions()
+	if err != nil {
+		return err
+	}
+	if current == 0 {
+		fmt.Fprintf(h.stdout, "Release %s has no failed revision to roll back\n", h.release)
+		return nil
+	}
+	if previous == 0 {
+		fmt.Fprintf(h.stdout, "Release %s has no earlier revision to roll back to\n", h.release)
+		return nil
+	}
+
+	args := h.globalFlags()
+	args = append(args, "rollback", h.release, strconv.Itoa(previous))
+	if h.wait {
+		args = append(args, "--wait")
+	}
+	if h.timeout != "" {
+		args = append(args, "--timeout", h.timeout)
+	}
+	rollback := command(helmBin, args...)
+	rollback.Stdout(h.stdout)
+	rollback.Stderr(h.stderr)
+	if h.debug {
+		fmt.Fprintf(h.stderr, "Generated command: '%s'\n", rollback.String())
+	}
+
+	fmt.Fprintf(h.stdout, "Rolling back %s from revision %d to revision %d\n", h.release, current, previous)
+	return rollback.Run()
+}
+
+// revisions finds the release's latest revision and, if the latest revision isn't deployed, the most recent revision
+// that was. It reads helm's release records, which are secrets labelled with each revision's number and status.
+func (h *failureHandler) revisions() (current, previous int, err error) {
+	selector := "owner=helm,name=" + h.release
+	records, err := h.clientset.CoreV1().Secrets(h.ns()).List(ctx.Background(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not list revisions of %s: %w", h.release, err)
+	}
+
+	statuses := make(map[int]string)
+	for _, record := range records.Items {
+		revision, err := strconv.Atoi(record.Labels["version"])
+		if err != nil {
+			continue
+		}
+		statuses[revision] = record.Labels["status"]
+		if revision > current {
+			current = revision
+		}
+	}
+	if statuses[current] == "deployed" {
+		// nothing was recorded for the failed upgrade, so there's nothing to undo
+		return 0, 0, nil
+	}
+	for revision := current - 1; revision > 0; revision-- {
+		if statuses[revision] == "superseded" || statuses[revision] == "deployed" {
+			return current, revision, nil
+		}
+	}
+	return current, 0, nil
+}
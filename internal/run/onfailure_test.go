@@ -0,0 +1,219 @@
+package run
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/stretchr/testify/suite"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type OnFailureTestSuite struct {
+	suite.Suite
+	ctrl            *gomock.Controller
+	mockCmd         *Mockcmd
+	originalCommand func(string, ...string) cmd
+	commandArgs     []string
+}
+
+func (suite *OnFailureTestSuite) BeforeTest(_, _ string) {
+	suite.ctrl = gomock.NewController(suite.T())
+	suite.mockCmd = NewMockcmd(suite.ctrl)
+
+	suite.originalCommand = command
+	suite.commandArgs = nil
+	command = func(path string, args ...string) cmd {
+		suite.commandArgs = args
+		return suite.mockCmd
+	}
+}
+
+func (suite *OnFailureTestSuite) AfterTest(_, _ string) {
+	command = suite.originalCommand
+}
+
+func TestOnFailureTestSuite(t *testing.T) {
+	suite.Run(t, new(OnFailureTestSuite))
+}
+
+func revisionRecord(release, revision, status string) *corev1.Secret {
+	return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Name:      "sh.helm.release.v1." + release + ".v" + revision,
+		Namespace: "ocean",
+		Labels:    map[string]string{"owner": "helm", "name": release, "version": revision, "status": status},
+	}}
+}
+
+func (suite *OnFailureTestSuite) TestNewFailureHandler() {
+	suite.Nil(newFailureHandler(env.Config{}))
+	suite.Nil(newFailureHandler(env.Config{OnFailure: []string{"rollback"}, DryRun: true}))
+
+	h := newFailureHandler(env.Config{OnFailure: []string{"diagnose"}, Release: "jellyfish", FailureLogLines: 7})
+	suite.Require().NotNil(h)
+	suite.Equal("jellyfish", h.release)
+	suite.Equal(int64(7), h.logLines)
+}
+
+func (suite *OnFailureTestSuite) TestPrepare() {
+	h := newFailureHandler(env.Config{OnFailure: []string{"diagnose", "rollback"}})
+	suite.Require().NoError(h.prepare())
+	suite.True(h.diagnose)
+	suite.True(h.rollback)
+
+	h = newFailureHandler(env.Config{OnFailure: []string{"panic"}})
+	suite.EqualError(h.prepare(), "unknown on_failure action 'panic': must be 'diagnose' or 'rollback'")
+
+	h = newFailureHandler(env.Config{OnFailure: []string{"rollback"}, AtomicUpgrade: true})
+	suite.EqualError(h.prepare(), "on_failure can't roll back when atomic_upgrade is set, since helm already rolls back atomic upgrades")
+
+	var none *failureHandler
+	suite.NoError(none.prepare())
+}
+
+func (suite *OnFailureTestSuite) TestDiagnostics() {
+	stderr := &strings.Builder{}
+	h := newFailureHandler(env.Config{
+		OnFailure:       []string{"diagnose"},
+		Release:         "jellyfish",
+		Namespace:       "ocean",
+		FailureLogLines: 20,
+		Stderr:          stderr,
+	})
+	h.clientset = fake.NewSimpleClientset(
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "jellyfish-web-1", Namespace: "ocean",
+				Labels: map[string]string{"app.kubernetes.io/instance": "jellyfish"}},
+			Status: corev1.PodStatus{
+				Phase: corev1.PodRunning,
+				ContainerStatuses: []corev1.ContainerStatus{{
+					Name:         "web",
+					RestartCount: 3,
+					State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{
+						Reason:  "CrashLoopBackOff",
+						Message: "back-off 40s restarting failed container",
+					}},
+				}},
+			},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "jellyfish-web-2", Namespace: "ocean",
+				Labels: map[string]string{"app.kubernetes.io/instance": "jellyfish"}},
+			Status: corev1.PodStatus{
+				Phase:             corev1.PodRunning,
+				ContainerStatuses: []corev1.ContainerStatus{{Name: "web", Ready: true}},
+			},
+		},
+		&corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: "jellyfish-web-1.1", Namespace: "ocean"},
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: "jellyfish-web-1"},
+			Type:           corev1.EventTypeWarning,
+			Reason:         "BackOff",
+			Message:        "Back-off restarting failed container",
+			Count:          12,
+		},
+		&corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: "jellyfish-web.1", Namespace: "ocean"},
+			InvolvedObject: corev1.ObjectReference{Kind: "Deployment", Name: "jellyfish-web"},
+			Type:           corev1.EventTypeWarning,
+			Reason:         "ProgressDeadlineExceeded",
+			Message:        "ReplicaSet has timed out progressing.",
+		},
+		&corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: "jellyfish-web-2.1", Namespace: "ocean"},
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: "jellyfish-web-2"},
+			Type:           corev1.EventTypeNormal,
+			Reason:         "Started",
+		},
+		&corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: "octopus.1", Namespace: "ocean"},
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: "octopus"},
+			Type:           corev1.EventTypeWarning,
+			Reason:         "BackOff",
+		},
+	)
+	suite.Require().NoError(h.prepare())
+
+	upgradeErr := errors.New("UPGRADE FAILED: timed out waiting for the condition")
+	suite.Equal(upgradeErr, h.handle(upgradeErr))
+
+	suite.Equal(`Diagnostics for release jellyfish in namespace ocean:
+Deployment/jellyfish-web:
+  event: ProgressDeadlineExceeded: ReplicaSet has timed out progressing.
+Pod/jellyfish-web-1:
+  status: Running, container web is waiting: CrashLoopBackOff back-off 40s restarting failed container
+  last 20 log lines of container web:
+    fake logs
+  event: BackOff: Back-off restarting failed container (x12)
+`, stderr.String())
+}
+
+func (suite *OnFailureTestSuite) TestRollback() {
+	defer suite.ctrl.Finish()
+
+	h := newFailureHandler(env.Config{
+		OnFailure: []string{"rollback"},
+		Release:   "jellyfish",
+		Namespace: "ocean",
+		Wait:      true,
+		Timeout:   "5m",
+		Stdout:    &strings.Builder{},
+	})
+	h.clientset = fake.NewSimpleClientset(
+		revisionRecord("jellyfish", "1", "superseded"),
+		revisionRecord("jellyfish", "2", "failed"),
+		revisionRecord("jellyfish", "3", "failed"),
+		revisionRecord("octopus", "4", "deployed"),
+	)
+	suite.Require().NoError(h.prepare())
+
+	suite.mockCmd.EXPECT().Stdout(gomock.Any())
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+	suite.mockCmd.EXPECT().Run().Return(errors.New("no cluster"))
+
+	err := h.handle(errors.New("UPGRADE FAILED"))
+	suite.EqualError(err, "UPGRADE FAILED; rollback also failed: no cluster")
+	suite.Equal([]string{"--namespace", "ocean", "rollback", "jellyfish", "1", "--wait", "--timeout", "5m"}, suite.commandArgs)
+}
+
+func (suite *OnFailureTestSuite) TestRollbackWithoutEarlierRevision() {
+	stdout := &strings.Builder{}
+	h := newFailureHandler(env.Config{OnFailure: []string{"rollback"}, Release: "jellyfish", Namespace: "ocean", Stdout: stdout})
+	h.clientset = fake.NewSimpleClientset(revisionRecord("jellyfish", "1", "failed"))
+	suite.Require().NoError(h.prepare())
+
+	suite.EqualError(h.handle(errors.New("UPGRADE FAILED")), "UPGRADE FAILED")
+	suite.Equal("Release jellyfish has no earlier revision to roll back to\n", stdout.String())
+	suite.Nil(suite.commandArgs)
+
+	stdout.Reset()
+	h.clientset = fake.NewSimpleClientset(revisionRecord("jellyfish", "1", "superseded"), revisionRecord("jellyfish", "2", "deployed"))
+	suite.EqualError(h.handle(errors.New("UPGRADE FAILED")), "UPGRADE FAILED")
+	suite.Equal("Release jellyfish has no failed revision to roll back\n", stdout.String())
+}
+
+func (suite *OnFailureTestSuite) TestUpgradeRunsOnFailure() {
+	defer suite.ctrl.Finish()
+
+	stderr := &strings.Builder{}
+	u := NewUpgrade(env.Config{
+		Chart:     "ocean/jellyfish",
+		Release:   "jellyfish",
+		OnFailure: []string{"diagnose"},
+		Stdout:    &strings.Builder{},
+		Stderr:    stderr,
+	})
+	u.onFailure.clientset = fake.NewSimpleClientset()
+
+	suite.mockCmd.EXPECT().Stdout(gomock.Any())
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+	suite.mockCmd.EXPECT().Run().Return(errors.New("UPGRADE FAILED"))
+
+	suite.Require().NoError(u.Prepare())
+	suite.EqualError(u.Execute(), "UPGRADE FAILED")
+	suite.Equal("Diagnostics for release jellyfish in namespace default:\n  no failing pods or warning events found\n", stderr.String())
+}
@@ -0,0 +1,283 @@
+package run
+
+import (
+	ctx "context"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/restmapper"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	// helm stores release records as secrets in the release namespace
+	storageVerbs  = []string{"get", "list", "create", "update", "delete"}
+	resourceVerbs = []string{"get", "create", "patch", "delete"}
+)
+
+// Preflight is a step in a helm Plan that checks the Kubernetes API server is reachable and that the credentials in
+// the kubeconfig are allowed to do everything the upgrade will need, before anything in the cluster is changed.
+type Preflight struct {
+	*config
+	kubeConfig   string
+	cluster      clientcmdapi.Cluster
+	chart        string
+	release      string
+	chartVersion string
+	setValues    *setValues
+	valuesFiles  *valuesFiles
+	certs        *repoCerts
+	clientset    kubernetes.Interface
+	cmd          cmd
+}
+
+// accessCheck is a single permission the plan needs.
+type accessCheck struct {
+	verb      string
+	group     string
+	resource  string
+	namespace string
+}
+
+// NewPreflight creates a Preflight using fields from the given Config and the kubeconfig filepath. No validation is
+// performed at this time.
+func NewPreflight(cfg env.Config, kubeConfig string) *Preflight {
+	return &Preflight{
+		config:       newConfig(cfg),
+		kubeConfig:   kubeConfig,
+		cluster:      kubeCluster(cfg),
+		chart:        cfg.Chart,
+		release:      cfg.Release,
+		chartVersion: cfg.ChartVersion,
+		setValues:    newSetValues(cfg),
+		valuesFiles:  newValuesFiles(cfg),
+		certs:        newRepoCerts(cfg),
+	}
+}
+
+// Prepare gets the Preflight ready to execute by generating the `helm template` command used to find out which
+// resource kinds the chart contains.
+func (p *Preflight) Prepare() error {
+	if p.chart == "" {
+		return fmt.Errorf("chart is required")
+	}
+	if p.release == "" {
+		return fmt.Errorf("release is required")
+	}
+
+	if err := p.valuesFiles.write(); err != nil {
+		return err
+	}
+	if err := p.certs.write(); err != nil {
+		return err
+	}
+
+	args := p.globalFlags()
+	args = append(args, "template")
+
+	if p.chartVersion != "" {
+		args = append(args, "--version", p.chartVersion)
+	}
+	args = append(args, p.setValues.flags()...)
+	args = append(args, p.valuesFiles.flags()...)
+	args = append(args, p.certs.flags()...)
+
+	args = append(args, p.release, p.chart)
+
+	p.cmd = command(helmBin, args...)
+	p.cmd.Stderr(p.stderr)
+
+	if p.debug {
+		fmt.Fprintf(p.stderr, "Generated command: '%s'\n", p.cmd.String())
+	}
+
+	return nil
+}
+
+// Execute connects to the cluster and runs a SelfSubjectAccessReview for every permission the upgrade needs.
+func (p *Preflight) Execute() error {
+	if p.clientset == nil {
+		clientset, err := clientsetFromFile(p.kubeConfig, p.cluster)
+		if err != nil {
+			return err
+		}
+		p.clientset = clientset
+	}
+
+	serverVersion, err := p.clientset.Discovery().ServerVersion()
+	if err != nil {
+		return fmt.Errorf("kubernetes API server is not reachable: %w", err)
+	}
+	fmt.Fprintf(p.stdout, "Kubernetes API server is reachable (version %s)\n", serverVersion.GitVersion)
+
+	manifest, err := p.cmd.Output()
+	if err != nil {
+		return fmt.Errorf("while rendering chart: %w", err)
+	}
+
+	checks, err := p.accessChecks(string(manifest))
+	if err != nil {
+		return err
+	}
+
+	var missing []accessCheck
+	for _, check := range checks {
+		allowed, err := p.allowed(check)
+		if err != nil {
+			return fmt.Errorf("while checking permission to %s %s: %w", check.verb, check.resource, err)
+		}
+		if !allowed {
+			missing = append(missing, check)
+		}
+	}
+
+	if len(missing) > 0 {
+		printMissingPermissions(p.stderr, missing)
+		return fmt.Errorf("missing %d permission(s) required to deploy", len(missing))
+	}
+
+	if p.debug {
+		fmt.Fprintf(p.stderr, "all %d permission checks passed\n", len(checks))
+	}
+	return nil
+}
+
+// Cleanup removes any temporary values and certificate files.
+func (p *Preflight) Cleanup() error {
+	if err := p.valuesFiles.cleanup(); err != nil {
+		return err
+	}
+	return p.certs.cleanup()
+}
+
+// accessChecks lists the permissions needed to store the release and manage every resource kind in the manifest.
+func (p *Preflight) accessChecks(manifest string) ([]accessCheck, error) {
+	// without a namespace setting, helm deploys into the kubeconfig context's namespace, so that's the one to check
+	releaseNamespace := p.namespace
+	if releaseNamespace == "" {
+		releaseNamespace = namespaceFromFile(p.kubeConfig)
+	}
+
+	var checks []accessCheck
+	for _, verb := range storageVerbs {
+		checks = append(checks, accessCheck{verb: verb, resource: "secrets", namespace: releaseNamespace})
+	}
+
+	groupResources, err := restmapper.GetAPIGroupResources(p.clientset.Discovery())
+	if err != nil {
+		return nil, fmt.Errorf("while discovering API resources: %w", err)
+	}
+	mapper := restmapper.NewDiscoveryRESTMapper(groupResources)
+
+	seen := map[accessCheck]bool{}
+	for _, check := range checks {
+		seen[check] = true
+	}
+
+	for _, doc := range sortedManifests(manifest) {
+		var resource struct {
+			metav1.TypeMeta   `json:",inline"`
+			metav1.ObjectMeta `json:"metadata,omitempty"`
+		}
+		if err := yaml.Unmarshal([]byte(doc), &resource); err != nil {
+			return nil, fmt.Errorf("while parsing rendered chart: %w", err)
+		}
+		if resource.Kind == "" {
+			continue
+		}
+
+		gvk := schema.FromAPIVersionAndKind(resource.APIVersion, resource.Kind)
+		mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil {
+			// the kind may be defined by a CRD the chart itself installs
+			fmt.Fprintf(p.stderr, "Warning: skipping permission checks for unknown kind %s\n", gvk.String())
+			continue
+		}
+
+		namespace := ""
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			namespace = releaseNamespace
+			if resource.Namespace != "" {
+				namespace = resource.Namespace
+			}
+		}
+
+		for _, verb := range resourceVerbs {
+			check := accessCheck{
+				verb:      verb,
+				group:     mapping.Resource.Group,
+				resource:  mapping.Resource.Resource,
+				namespace: namespace,
+			}
+			if !seen[check] {
+				seen[check] = true
+				checks = append(checks, check)
+			}
+		}
+	}
+
+	return checks, nil
+}
+
+func (p *Preflight) allowed(check accessCheck) (bool, error) {
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: check.namespace,
+				Verb:      check.verb,
+				Group:     check.group,
+				Resource:  check.resource,
+			},
+		},
+	}
+
+	result, err := p.clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx.Background(), review, metav1.CreateOptions{})
+	if err != nil {
+		return false, err
+	}
+	return result.Status.Allowed, nil
+}
+
+// sortedManifests splits a multi-document manifest, preserving the order helm rendered it in.
+func sortedManifests(manifest string) []string {
+	split := releaseutil.SplitManifests(manifest)
+	keys := make([]string, 0, len(split))
+	for key := range split {
+		keys = append(keys, key)
+	}
+	sort.Sort(releaseutil.BySplitManifestsOrder(keys))
+
+	docs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		docs = append(docs, split[key])
+	}
+	return docs
+}
+
+func printMissingPermissions(w io.Writer, missing []accessCheck) {
+	fmt.Fprintln(w, "The following permissions are required but were not granted:")
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "VERB\tRESOURCE\tNAMESPACE")
+	for _, check := range missing {
+		resource := check.resource
+		if check.group != "" {
+			resource = check.resource + "." + check.group
+		}
+		namespace := check.namespace
+		if namespace == "" {
+			namespace = "(cluster)"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\n", check.verb, resource, namespace)
+	}
+	table.Flush()
+}
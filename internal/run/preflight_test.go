@@ -0,0 +1,262 @@
+package run
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/stretchr/testify/suite"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const preflightManifest = `---
+# Source: mychart/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: mychart
+---
+# Source: mychart/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: mychart
+---
+# Source: mychart/templates/widget.yaml
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: mychart
+`
+
+type PreflightTestSuite struct {
+	suite.Suite
+	ctrl            *gomock.Controller
+	mockCmd         *Mockcmd
+	originalCommand func(string, ...string) cmd
+}
+
+func (suite *PreflightTestSuite) BeforeTest(_, _ string) {
+	suite.ctrl = gomock.NewController(suite.T())
+	suite.mockCmd = NewMockcmd(suite.ctrl)
+
+	suite.originalCommand = command
+	command = func(path string, args ...string) cmd { return suite.mockCmd }
+}
+
+func (suite *PreflightTestSuite) AfterTest(_, _ string) {
+	command = suite.originalCommand
+}
+
+func TestPreflightTestSuite(t *testing.T) {
+	suite.Run(t, new(PreflightTestSuite))
+}
+
+func (suite *PreflightTestSuite) TestNewPreflight() {
+	cfg := env.Config{
+		Chart:        "ballet",
+		Release:      "swan_lake",
+		ChartVersion: "1877",
+		Values:       env.ValueList{"acts=4"},
+		StringValues: env.ValueList{"composer=tchaikovsky"},
+		ValuesFiles:  []string{"/usr/local/libretto.yml"},
+	}
+	p := NewPreflight(cfg, "/root/.kube/config")
+
+	suite.Equal("ballet", p.chart)
+	suite.Equal("swan_lake", p.release)
+	suite.Equal("1877", p.chartVersion)
+	suite.Equal([]string{"acts=4"}, p.setValues.values)
+	suite.Equal([]string{"composer=tchaikovsky"}, p.setValues.stringValues)
+	suite.Equal([]string{"/usr/local/libretto.yml"}, p.valuesFiles.files)
+	suite.Equal("/root/.kube/config", p.kubeConfig)
+	suite.NotNil(p.config)
+}
+
+func (suite *PreflightTestSuite) TestPrepare() {
+	defer suite.ctrl.Finish()
+
+	cfg := env.Config{
+		Chart:        "ballet",
+		Release:      "swan_lake",
+		Namespace:    "bolshoi",
+		ChartVersion: "1877",
+		Values:       env.ValueList{"acts=4"},
+		StringValues: env.ValueList{"composer=tchaikovsky"},
+		ValuesFiles:  []string{"/usr/local/libretto.yml"},
+	}
+	p := NewPreflight(cfg, "")
+
+	command = func(path string, args ...string) cmd {
+		suite.Equal(helmBin, path)
+		suite.Equal([]string{"--namespace", "bolshoi", "template",
+			"--version", "1877",
+			"--set", "acts=4",
+			"--set-string", "composer=tchaikovsky",
+			"--values", "/usr/local/libretto.yml",
+			"swan_lake", "ballet"}, args)
+
+		return suite.mockCmd
+	}
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+
+	suite.NoError(p.Prepare())
+}
+
+func (suite *PreflightTestSuite) TestPrepareWithRepoCertificates() {
+	defer suite.ctrl.Finish()
+
+	cfg := env.Config{
+		Chart:             "ballet",
+		Release:           "swan_lake",
+		RepoCertificate:   "bGljZW5zZWQgdG8gZW50ZXJ0YWlu",
+		RepoCACertificate: "bG9jYWwgZmFjdG9yeQ==",
+	}
+	p := NewPreflight(cfg, "")
+
+	var args []string
+	command = func(path string, a ...string) cmd {
+		args = a
+		return suite.mockCmd
+	}
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+
+	suite.Require().NoError(p.Prepare())
+	suite.Equal([]string{"template", "--cert-file", p.certs.certFilename, "--ca-file", p.certs.caCertFilename,
+		"swan_lake", "ballet"}, args, "a chart from a private repo should render as it would for the upgrade")
+
+	certFile := p.certs.certFilename
+	suite.Require().NoError(p.Cleanup())
+	suite.NoFileExists(certFile)
+}
+
+func (suite *PreflightTestSuite) TestPrepareRequiresChartAndRelease() {
+	p := NewPreflight(env.Config{Release: "swan_lake"}, "")
+	suite.EqualError(p.Prepare(), "chart is required")
+
+	p = NewPreflight(env.Config{Chart: "ballet"}, "")
+	suite.EqualError(p.Prepare(), "release is required")
+}
+
+func (suite *PreflightTestSuite) TestExecuteAllowed() {
+	defer suite.ctrl.Finish()
+
+	stdout := &strings.Builder{}
+	stderr := &strings.Builder{}
+	p := NewPreflight(env.Config{Chart: "ballet", Release: "swan_lake", Namespace: "bolshoi", Stdout: stdout, Stderr: stderr}, "")
+
+	var reviewed []authorizationv1.ResourceAttributes
+	p.clientset = preflightClientset(func(attrs authorizationv1.ResourceAttributes) bool {
+		reviewed = append(reviewed, attrs)
+		return true
+	})
+
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+	suite.mockCmd.EXPECT().Output().Return([]byte(preflightManifest), nil)
+
+	suite.Require().NoError(p.Prepare())
+	suite.Require().NoError(p.Execute())
+
+	suite.Contains(stdout.String(), "Kubernetes API server is reachable (version v1.23.4)")
+	suite.Contains(stderr.String(), "skipping permission checks for unknown kind example.com/v1, Kind=Widget")
+
+	suite.Len(reviewed, len(storageVerbs)+2*len(resourceVerbs))
+	suite.Contains(reviewed, authorizationv1.ResourceAttributes{Namespace: "bolshoi", Verb: "create", Resource: "secrets"})
+	suite.Contains(reviewed, authorizationv1.ResourceAttributes{Namespace: "bolshoi", Verb: "patch", Resource: "services"})
+	suite.Contains(reviewed, authorizationv1.ResourceAttributes{Namespace: "bolshoi", Verb: "delete", Group: "apps", Resource: "deployments"})
+}
+
+func (suite *PreflightTestSuite) TestExecuteDefaultsToContextNamespace() {
+	defer suite.ctrl.Finish()
+
+	kubeConfig := filepath.Join(suite.T().TempDir(), "config")
+	suite.Require().NoError(os.WriteFile(kubeConfig, []byte(`apiVersion: v1
+kind: Config
+clusters:
+- cluster:
+    server: https://kube.example.com
+  name: helm
+contexts:
+- context:
+    cluster: helm
+    namespace: mariinsky
+    user: helm
+  name: helm
+current-context: helm
+users:
+- name: helm
+`), 0600))
+	p := NewPreflight(env.Config{Chart: "ballet", Release: "swan_lake", Stdout: &strings.Builder{}, Stderr: &strings.Builder{}}, kubeConfig)
+
+	namespaces := map[string]bool{}
+	p.clientset = preflightClientset(func(attrs authorizationv1.ResourceAttributes) bool {
+		namespaces[attrs.Namespace] = true
+		return true
+	})
+
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+	suite.mockCmd.EXPECT().Output().Return([]byte(preflightManifest), nil)
+
+	suite.Require().NoError(p.Prepare())
+	suite.Require().NoError(p.Execute())
+	suite.Equal(map[string]bool{"mariinsky": true}, namespaces, "namespaced checks shouldn't ask for cluster-wide access")
+}
+
+func (suite *PreflightTestSuite) TestExecuteMissingPermissions() {
+	defer suite.ctrl.Finish()
+
+	stderr := &strings.Builder{}
+	p := NewPreflight(env.Config{Chart: "ballet", Release: "swan_lake", Namespace: "bolshoi", Stdout: &strings.Builder{}, Stderr: stderr}, "")
+	p.clientset = preflightClientset(func(attrs authorizationv1.ResourceAttributes) bool {
+		return attrs.Resource != "deployments" || attrs.Verb == "get"
+	})
+
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+	suite.mockCmd.EXPECT().Output().Return([]byte(preflightManifest), nil)
+
+	suite.Require().NoError(p.Prepare())
+	suite.EqualError(p.Execute(), "missing 3 permission(s) required to deploy")
+
+	suite.Contains(stderr.String(), "The following permissions are required but were not granted:")
+	suite.Regexp(`VERB +RESOURCE +NAMESPACE\n`, stderr.String())
+	suite.Regexp(`create +deployments.apps +bolshoi\n`, stderr.String())
+	suite.Regexp(`patch +deployments.apps +bolshoi\n`, stderr.String())
+	suite.Regexp(`delete +deployments.apps +bolshoi\n`, stderr.String())
+}
+
+func preflightClientset(allow func(authorizationv1.ResourceAttributes) bool) *fake.Clientset {
+	clientset := fake.NewSimpleClientset()
+	clientset.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "secrets", Kind: "Secret", Namespaced: true},
+				{Name: "services", Kind: "Service", Namespaced: true},
+			},
+		},
+		{
+			GroupVersion: "apps/v1",
+			APIResources: []metav1.APIResource{
+				{Name: "deployments", Kind: "Deployment", Namespaced: true},
+			},
+		},
+	}
+	clientset.Discovery().(*fakediscovery.FakeDiscovery).FakedServerVersion = &version.Info{GitVersion: "v1.23.4"}
+
+	clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		review.Status.Allowed = allow(*review.Spec.ResourceAttributes)
+		return true, review, nil
+	})
+
+	return clientset
+}
@@ -0,0 +1,300 @@
+package run
+
+import (
+	ctx "context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+const (
+	previewLabel            = "drone-helm3/preview"
+	previewRepoLabel        = "drone-helm3/repo"
+	previewPullRequestLabel = "drone-helm3/pull-request"
+	previewReleaseLabel     = "drone-helm3/release"
+	previewExpiryAnnotation = "drone-helm3/expires-at"
+
+	// helm release names are limited to 53 characters, which also keeps namespace names well within DNS limits
+	maxPreviewNameLength = 53
+)
+
+var notDNSLabel = regexp.MustCompile(`[^a-z0-9]+`)
+
+// PreviewName derives the release and namespace name for a pull request's preview environment, e.g.
+// `hello-world-5d41a4-pr-42`. It returns an empty string when the build isn't for a pull request.
+func PreviewName(cfg env.Config) string {
+	if cfg.PullRequest == "" {
+		return ""
+	}
+	suffix := "-pr-" + dnsLabel(cfg.PullRequest)
+
+	repo := previewRepo(cfg.Repo, maxPreviewNameLength-len(suffix))
+	if repo == "" {
+		repo = "preview"
+	}
+	return repo + suffix
+}
+
+// previewRepo identifies the repository in preview names and labels, in at most max characters. It's the repository's
+// name followed by a short hash of its full slug, e.g. `hello-world-5d41a4`, so repositories with the same name under
+// different owners don't share preview environments. When it's too long, the name is shortened, not the hash.
+func previewRepo(repo string, max int) string {
+	if repo == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.ToLower(repo)))
+	hash := hex.EncodeToString(sum[:])[:6]
+
+	name := dnsLabel(path.Base(repo))
+	if limit := max - len(hash) - 1; len(name) > limit {
+		name = strings.TrimRight(name[:limit], "-")
+	}
+	if name == "" {
+		return hash
+	}
+	return name + "-" + hash
+}
+
+// dnsLabel lowercases s and replaces anything that isn't allowed in a DNS label with hyphens.
+func dnsLabel(s string) string {
+	return strings.Trim(notDNSLabel.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
+
+// Preview is a step that prepares a pull request's preview environment: it creates or relabels its namespace and
+// writes the release and namespace names to a dotenv file for later pipeline steps.
+type Preview struct {
+	*config
+	kubeConfig  string
+	cluster     clientcmdapi.Cluster
+	name        string
+	repo        string
+	pullRequest string
+	ttl         string
+	expiresAt   time.Time
+	envFile     string
+	clientset   kubernetes.Interface
+}
+
+// NewPreview creates a Preview using fields from the given Config and the kubeconfig filepath. No validation is
+// performed at this time.
+func NewPreview(cfg env.Config, kubeConfig string) *Preview {
+	return &Preview{
+		config:      newConfig(cfg),
+		kubeConfig:  kubeConfig,
+		cluster:     kubeCluster(cfg),
+		name:        PreviewName(cfg),
+		repo:        previewRepo(cfg.Repo, validation.LabelValueMaxLength),
+		pullRequest: cfg.PullRequest,
+		ttl:         cfg.PreviewTTL,
+		envFile:     cfg.PreviewEnvFile,
+	}
+}
+
+// Prepare gets the Preview ready to execute.
+func (p *Preview) Prepare() error {
+	if p.name == "" {
+		return fmt.Errorf("preview mode only works for pull requests, and DRONE_PULL_REQUEST is not set")
+	}
+	if p.ttl != "" {
+		ttl, err := time.ParseDuration(p.ttl)
+		if err != nil {
+			return fmt.Errorf("invalid preview_ttl: %w", err)
+		}
+		p.expiresAt = time.Now().Add(ttl).UTC()
+	}
+	return nil
+}
+
+// Execute creates the preview namespace, or refreshes its labels and expiry if it already exists. An existing namespace
+// that isn't labelled as a preview environment is an error.
+func (p *Preview) Execute() error {
+	if p.clientset == nil {
+		clientset, err := clientsetFromFile(p.kubeConfig, p.cluster)
+		if err != nil {
+			return err
+		}
+		p.clientset = clientset
+	}
+
+	namespaces := p.clientset.CoreV1().Namespaces()
+	namespace, err := namespaces.Get(ctx.Background(), p.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		namespace = &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: p.name}}
+		p.label(namespace)
+		if _, err := namespaces.Create(ctx.Background(), namespace, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("could not create namespace %s: %w", p.name, err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("could not get namespace %s: %w", p.name, err)
+	} else {
+		// preview_cleanup deletes labelled namespaces, so one that isn't already a preview environment is left alone
+		if namespace.Labels[previewLabel] != "true" {
+			return fmt.Errorf("namespace %s already exists and isn't a preview environment", p.name)
+		}
+		p.label(namespace)
+		if _, err := namespaces.Update(ctx.Background(), namespace, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("could not update namespace %s: %w", p.name, err)
+		}
+	}
+
+	fmt.Fprintf(p.stdout, "Deploying preview environment %s\n", p.name)
+	return p.writeEnvFile()
+}
+
+func (p *Preview) label(namespace *corev1.Namespace) {
+	if namespace.Labels == nil {
+		namespace.Labels = map[string]string{}
+	}
+	namespace.Labels[previewLabel] = "true"
+	namespace.Labels[previewRepoLabel] = p.repo
+	namespace.Labels[previewPullRequestLabel] = dnsLabel(p.pullRequest)
+	namespace.Labels[previewReleaseLabel] = p.name
+
+	if !p.expiresAt.IsZero() {
+		if namespace.Annotations == nil {
+			namespace.Annotations = map[string]string{}
+		}
+		namespace.Annotations[previewExpiryAnnotation] = p.expiresAt.Format(time.RFC3339)
+	}
+}
+
+func (p *Preview) writeEnvFile() error {
+	if p.envFile == "" {
+		return nil
+	}
+	contents := fmt.Sprintf("PREVIEW_RELEASE=%s\nPREVIEW_NAMESPACE=%s\n", p.name, p.name)
+	if err := os.WriteFile(p.envFile, []byte(contents), 0644); err != nil {
+		return fmt.Errorf("could not write preview_env_file: %w", err)
+	}
+	if p.debug {
+		fmt.Fprintf(p.stderr, "wrote preview environment names to %s\n", p.envFile)
+	}
+	return nil
+}
+
+// PreviewCleanup is a step that removes preview environments: the current pull request's, if there is one, and any
+// whose TTL has run out. It uninstalls each one's release and deletes its namespace.
+type PreviewCleanup struct {
+	*config
+	kubeConfig  string
+	cluster     clientcmdapi.Cluster
+	repo        string
+	pullRequest string
+	dryRun      bool
+	clientset   kubernetes.Interface
+}
+
+// NewPreviewCleanup creates a PreviewCleanup using fields from the given Config and the kubeconfig filepath. No
+// validation is performed at this time.
+func NewPreviewCleanup(cfg env.Config, kubeConfig string) *PreviewCleanup {
+	return &PreviewCleanup{
+		config:      newConfig(cfg),
+		kubeConfig:  kubeConfig,
+		cluster:     kubeCluster(cfg),
+		repo:        previewRepo(cfg.Repo, validation.LabelValueMaxLength),
+		pullRequest: cfg.PullRequest,
+		dryRun:      cfg.DryRun,
+	}
+}
+
+// Prepare gets the PreviewCleanup ready to execute.
+func (pc *PreviewCleanup) Prepare() error {
+	if pc.repo == "" {
+		return fmt.Errorf("preview_cleanup mode needs DRONE_REPO to find the repository's preview environments")
+	}
+	return nil
+}
+
+// Execute uninstalls and deletes every expired preview environment. An environment that can't be removed doesn't stop
+// the others from being removed.
+func (pc *PreviewCleanup) Execute() error {
+	if pc.clientset == nil {
+		clientset, err := clientsetFromFile(pc.kubeConfig, pc.cluster)
+		if err != nil {
+			return err
+		}
+		pc.clientset = clientset
+	}
+
+	selector := fmt.Sprintf("%s=true,%s=%s", previewLabel, previewRepoLabel, pc.repo)
+	namespaces, err := pc.clientset.CoreV1().Namespaces().List(ctx.Background(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return fmt.Errorf("could not list preview namespaces: %w", err)
+	}
+
+	now := time.Now()
+	expired, failed := 0, 0
+	for _, namespace := range namespaces.Items {
+		if !pc.expired(namespace, now) {
+			continue
+		}
+		expired++
+		if err := pc.remove(namespace); err != nil {
+			fmt.Fprintf(pc.stderr, "Could not remove preview environment %s: %s\n", namespace.Name, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to remove %d of %d preview environments", failed, expired)
+	}
+	return nil
+}
+
+func (pc *PreviewCleanup) expired(namespace corev1.Namespace, now time.Time) bool {
+	if pc.pullRequest != "" && namespace.Labels[previewPullRequestLabel] == dnsLabel(pc.pullRequest) {
+		return true
+	}
+	expiresAt, err := time.Parse(time.RFC3339, namespace.Annotations[previewExpiryAnnotation])
+	return err == nil && now.After(expiresAt)
+}
+
+// remove uninstalls the preview environment's release and deletes its namespace. A release that doesn't exist, e.g.
+// because its installation failed, doesn't stop the namespace from being deleted.
+func (pc *PreviewCleanup) remove(namespace corev1.Namespace) error {
+	fmt.Fprintf(pc.stdout, "Removing preview environment %s\n", namespace.Name)
+	if pc.dryRun {
+		return nil
+	}
+
+	release := namespace.Labels[previewReleaseLabel]
+	if release == "" {
+		release = namespace.Name
+	}
+	flags := *pc.config
+	flags.namespace = namespace.Name
+	args := append(flags.globalFlags(), "uninstall", release)
+
+	uninstall := command(helmBin, args...)
+	output := &strings.Builder{}
+	uninstall.Stdout(pc.stdout)
+	uninstall.Stderr(io.MultiWriter(pc.stderr, output))
+	if pc.debug {
+		fmt.Fprintf(pc.stderr, "Generated command: '%s'\n", uninstall.String())
+	}
+	if err := uninstall.Run(); err != nil {
+		if !strings.Contains(output.String(), "release: not found") {
+			return fmt.Errorf("while uninstalling %s: %w", release, err)
+		}
+		fmt.Fprintf(pc.stdout, "Release %s was already uninstalled\n", release)
+	}
+
+	err := pc.clientset.CoreV1().Namespaces().Delete(ctx.Background(), namespace.Name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("could not delete namespace %s: %w", namespace.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package run
+
+import (
+	ctx "context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type PreviewTestSuite struct {
+	suite.Suite
+	ctrl            *gomock.Controller
+	mockCmd         *Mockcmd
+	originalCommand func(string, ...string) cmd
+}
+
+func (suite *PreviewTestSuite) BeforeTest(_, _ string) {
+	suite.ctrl = gomock.NewController(suite.T())
+	suite.mockCmd = NewMockcmd(suite.ctrl)
+
+	suite.originalCommand = command
+	command = func(path string, args ...string) cmd { return suite.mockCmd }
+}
+
+func (suite *PreviewTestSuite) AfterTest(_, _ string) {
+	command = suite.originalCommand
+}
+
+func TestPreviewTestSuite(t *testing.T) {
+	suite.Run(t, new(PreviewTestSuite))
+}
+
+func (suite *PreviewTestSuite) TestPreviewName() {
+	suite.Equal("hello-world-72fc32-pr-42", PreviewName(env.Config{Repo: "octocat/Hello_World", PullRequest: "42"}))
+	suite.Equal("preview-pr-42", PreviewName(env.Config{PullRequest: "42"}))
+	suite.Equal("", PreviewName(env.Config{Repo: "octocat/Hello_World"}))
+
+	suite.NotEqual(PreviewName(env.Config{Repo: "octocat/hello-world", PullRequest: "42"}),
+		PreviewName(env.Config{Repo: "monalisa/hello-world", PullRequest: "42"}),
+		"repositories with the same name under different owners should have different previews")
+
+	long := PreviewName(env.Config{Repo: "octocat/" + strings.Repeat("spoon-", 20), PullRequest: "1234"})
+	suite.LessOrEqual(len(long), maxPreviewNameLength)
+	suite.True(strings.HasSuffix(long, "-pr-1234"), "the pull request number should survive truncation")
+	suite.Regexp("-[0-9a-f]{6}-pr-1234$", long, "the repository's hash should survive truncation")
+	suite.NotContains(long, "--")
+}
+
+func (suite *PreviewTestSuite) TestPrepare() {
+	p := NewPreview(env.Config{Repo: "octocat/hello-world"}, "")
+	suite.EqualError(p.Prepare(), "preview mode only works for pull requests, and DRONE_PULL_REQUEST is not set")
+
+	p = NewPreview(env.Config{Repo: "octocat/hello-world", PullRequest: "42", PreviewTTL: "a fortnight"}, "")
+	suite.Regexp("^invalid preview_ttl", p.Prepare())
+
+	p = NewPreview(env.Config{Repo: "octocat/hello-world", PullRequest: "42", PreviewTTL: "72h"}, "")
+	suite.Require().NoError(p.Prepare())
+	suite.WithinDuration(time.Now().Add(72*time.Hour), p.expiresAt, time.Minute)
+}
+
+func (suite *PreviewTestSuite) TestExecuteCreatesNamespace() {
+	envFile := filepath.Join(suite.T().TempDir(), ".preview.env")
+	p := NewPreview(env.Config{
+		Repo:           "octocat/hello-world",
+		PullRequest:    "42",
+		PreviewTTL:     "24h",
+		PreviewEnvFile: envFile,
+		Stdout:         &strings.Builder{},
+	}, "")
+	clientset := fake.NewSimpleClientset()
+	p.clientset = clientset
+
+	suite.Require().NoError(p.Prepare())
+	suite.Require().NoError(p.Execute())
+
+	namespace, err := clientset.CoreV1().Namespaces().Get(ctx.Background(), "hello-world-9495a7-pr-42", metav1.GetOptions{})
+	suite.Require().NoError(err)
+	suite.Equal(map[string]string{
+		previewLabel:            "true",
+		previewRepoLabel:        "hello-world-9495a7",
+		previewPullRequestLabel: "42",
+		previewReleaseLabel:     "hello-world-9495a7-pr-42",
+	}, namespace.Labels)
+	suite.Contains(namespace.Annotations, previewExpiryAnnotation)
+
+	contents, err := os.ReadFile(envFile)
+	suite.Require().NoError(err)
+	suite.Equal("PREVIEW_RELEASE=hello-world-9495a7-pr-42\nPREVIEW_NAMESPACE=hello-world-9495a7-pr-42\n", string(contents))
+}
+
+func (suite *PreviewTestSuite) TestExecuteUpdatesExistingNamespace() {
+	p := NewPreview(env.Config{Repo: "octocat/hello-world", PullRequest: "42", Stdout: &strings.Builder{}}, "")
+	clientset := fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:   "hello-world-9495a7-pr-42",
+		Labels: map[string]string{"team": "spoons", previewLabel: "true"},
+	}})
+	p.clientset = clientset
+
+	suite.Require().NoError(p.Prepare())
+	suite.Require().NoError(p.Execute())
+
+	namespace, err := clientset.CoreV1().Namespaces().Get(ctx.Background(), "hello-world-9495a7-pr-42", metav1.GetOptions{})
+	suite.Require().NoError(err)
+	suite.Equal("spoons", namespace.Labels["team"])
+	suite.Equal("hello-world-9495a7", namespace.Labels[previewRepoLabel])
+}
+
+func (suite *PreviewTestSuite) TestExecuteRefusesOtherNamespaces() {
+	p := NewPreview(env.Config{Repo: "octocat/hello-world", PullRequest: "42", Stdout: &strings.Builder{}}, "")
+	clientset := fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:   "hello-world-9495a7-pr-42",
+		Labels: map[string]string{"team": "spoons"},
+	}})
+	p.clientset = clientset
+
+	suite.Require().NoError(p.Prepare())
+	suite.EqualError(p.Execute(), "namespace hello-world-9495a7-pr-42 already exists and isn't a preview environment")
+
+	namespace, err := clientset.CoreV1().Namespaces().Get(ctx.Background(), "hello-world-9495a7-pr-42", metav1.GetOptions{})
+	suite.Require().NoError(err)
+	suite.NotContains(namespace.Labels, previewLabel, "the namespace shouldn't become eligible for preview_cleanup")
+}
+
+func (suite *PreviewTestSuite) TestCleanup() {
+	defer suite.ctrl.Finish()
+
+	expired := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	live := time.Now().Add(time.Hour).Format(time.RFC3339)
+	clientset := fake.NewSimpleClientset(
+		previewNamespace("hello-world-9495a7-pr-1", "hello-world-9495a7", "1", expired),
+		previewNamespace("hello-world-9495a7-pr-2", "hello-world-9495a7", "2", live),
+		previewNamespace("hello-world-9495a7-pr-3", "hello-world-9495a7", "3", live),
+		// the same repository name under another owner
+		previewNamespace("hello-world-76d444-pr-4", "hello-world-76d444", "4", expired),
+	)
+
+	pc := NewPreviewCleanup(env.Config{Repo: "octocat/hello-world", PullRequest: "3", KubeConfigPath: "/root/.kube/config", Stdout: &strings.Builder{}}, "/root/.kube/config")
+	pc.clientset = clientset
+
+	var uninstalled []string
+	command = func(path string, args ...string) cmd {
+		suite.Equal(helmBin, path)
+		uninstalled = append(uninstalled, args[5])
+		suite.Equal([]string{"--namespace", args[5], "--kubeconfig", "/root/.kube/config", "uninstall", args[5]}, args)
+		return suite.mockCmd
+	}
+	suite.mockCmd.EXPECT().Stdout(gomock.Any()).Times(2)
+	suite.mockCmd.EXPECT().Stderr(gomock.Any()).Times(2)
+	suite.mockCmd.EXPECT().Run().Times(2)
+
+	suite.Require().NoError(pc.Prepare())
+	suite.Require().NoError(pc.Execute())
+
+	suite.ElementsMatch([]string{"hello-world-9495a7-pr-1", "hello-world-9495a7-pr-3"}, uninstalled)
+	suite.ElementsMatch([]string{"hello-world-9495a7-pr-2", "hello-world-76d444-pr-4"}, namespaceNames(suite.T(), clientset))
+}
+
+func (suite *PreviewTestSuite) TestCleanupContinuesAfterFailures() {
+	defer suite.ctrl.Finish()
+
+	expired := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	clientset := fake.NewSimpleClientset(
+		previewNamespace("hello-world-9495a7-pr-1", "hello-world-9495a7", "1", expired),
+		previewNamespace("hello-world-9495a7-pr-2", "hello-world-9495a7", "2", expired),
+		previewNamespace("hello-world-9495a7-pr-3", "hello-world-9495a7", "3", expired),
+	)
+	stderr := &strings.Builder{}
+	pc := NewPreviewCleanup(env.Config{Repo: "octocat/hello-world", Stdout: &strings.Builder{}, Stderr: stderr}, "")
+	pc.clientset = clientset
+
+	command = func(path string, args ...string) cmd {
+		release := args[len(args)-1]
+		var output io.Writer
+		uninstall := NewMockcmd(suite.ctrl)
+		uninstall.EXPECT().Stdout(gomock.Any())
+		uninstall.EXPECT().Stderr(gomock.Any()).Do(func(w io.Writer) { output = w })
+		uninstall.EXPECT().Run().DoAndReturn(func() error {
+			switch release {
+			case "hello-world-9495a7-pr-1":
+				// its installation failed, so there's no release
+				fmt.Fprintf(output, "Error: uninstall: Release not loaded: %s: release: not found\n", release)
+				return fmt.Errorf("exit status 1")
+			case "hello-world-9495a7-pr-2":
+				fmt.Fprintf(output, "Error: uninstall: the server has asked for the client to provide credentials\n")
+				return fmt.Errorf("exit status 1")
+			}
+			return nil
+		})
+		return uninstall
+	}
+
+	suite.EqualError(pc.Execute(), "failed to remove 1 of 3 preview environments")
+	suite.Contains(stderr.String(), "Could not remove preview environment hello-world-9495a7-pr-2: while uninstalling hello-world-9495a7-pr-2: exit status 1")
+	suite.Equal([]string{"hello-world-9495a7-pr-2"}, namespaceNames(suite.T(), clientset),
+		"only the environment whose release couldn't be uninstalled should be left")
+}
+
+func namespaceNames(t *testing.T, clientset *fake.Clientset) []string {
+	namespaces, err := clientset.CoreV1().Namespaces().List(ctx.Background(), metav1.ListOptions{})
+	require.NoError(t, err)
+	var names []string
+	for _, namespace := range namespaces.Items {
+		names = append(names, namespace.Name)
+	}
+	return names
+}
+
+func previewNamespace(name, repo, pullRequest, expiresAt string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name: name,
+		Labels: map[string]string{
+			previewLabel:            "true",
+			previewRepoLabel:        repo,
+			previewPullRequestLabel: pullRequest,
+			previewReleaseLabel:     name,
+		},
+		Annotations: map[string]string{previewExpiryAnnotation: expiresAt},
+	}}
+}
@@ -0,0 +1,161 @@
+package run
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/release"
+	"sigs.k8s.io/yaml"
+)
+
+// releaseSource identifies a deployed release, possibly in another cluster.
+type releaseSource struct {
+	kubeConfig  string
+	kubeContext string
+	namespace   string
+	name        string
+}
+
+// getRelease reads a deployed release through the Helm SDK. It's a variable so the tests can replace it.
+var getRelease = func(source releaseSource, debug action.DebugLog) (*release.Release, error) {
+	settings := cli.New()
+	settings.KubeConfig = source.kubeConfig
+	settings.KubeContext = source.kubeContext
+
+	actionCfg := new(action.Configuration)
+	if err := actionCfg.Init(settings.RESTClientGetter(), source.namespace, "secrets", debug); err != nil {
+		return nil, err
+	}
+	return action.NewGet(actionCfg).Run(source.name)
+}
+
+// Promote is an execution step that deploys the exact chart and user-supplied values of a release in another
+// environment, e.g. staging, to the target release. The target's own values_files and values are layered on top.
+type Promote struct {
+	*config
+	cfg      env.Config
+	source   releaseSource
+	tempDir  string
+	upgrade  *Upgrade
+	debugLog action.DebugLog
+}
+
+// NewPromote creates a Promote using fields from the given Config and the kubeconfig filepath. No validation is
+// performed at this time.
+func NewPromote(cfg env.Config, kubeConfig string) *Promote {
+	source := releaseSource{
+		kubeConfig:  cfg.SourceKubeConfig,
+		kubeContext: cfg.SourceKubeContext,
+		namespace:   cfg.SourceNamespace,
+		name:        cfg.SourceRelease,
+	}
+	if source.kubeConfig == "" {
+		source.kubeConfig = kubeConfig
+	}
+	if source.namespace == "" {
+		source.namespace = cfg.Namespace
+	}
+	if source.name == "" {
+		source.name = cfg.Release
+	}
+
+	promote := &Promote{
+		config:   newConfig(cfg),
+		cfg:      cfg,
+		source:   source,
+		debugLog: func(string, ...interface{}) {},
+	}
+	if cfg.Debug {
+		promote.debugLog = func(format string, v ...interface{}) {
+			fmt.Fprintf(cfg.Stderr, "[debug] %s\n", fmt.Sprintf(format, v...))
+		}
+	}
+	return promote
+}
+
+// Prepare checks that the source and target releases are known and aren't the same release.
+func (p *Promote) Prepare() error {
+	if p.cfg.Release == "" {
+		return fmt.Errorf("release is required")
+	}
+	if p.source.name == p.cfg.Release && p.source.namespace == p.cfg.Namespace &&
+		p.cfg.SourceKubeConfig == "" && p.cfg.SourceKubeContext == "" {
+		return fmt.Errorf("source_release or source_namespace must point to a different release than the target")
+	}
+	return nil
+}
+
+// Execute reads the source release, then upgrades the target release with its chart and values.
+func (p *Promote) Execute() error {
+	source, err := getRelease(p.source, p.debugLog)
+	if err != nil {
+		return fmt.Errorf("could not read release %s in namespace %s: %w", p.source.name, p.source.namespace, err)
+	}
+	if source.Chart == nil || source.Chart.Metadata == nil {
+		return fmt.Errorf("release %s in namespace %s has no chart", p.source.name, p.source.namespace)
+	}
+	fmt.Fprintf(p.stdout, "Promoting %s %s (revision %d of %s in namespace %s)\n",
+		source.Chart.Metadata.Name, source.Chart.Metadata.Version, source.Version, p.source.name, p.source.namespace)
+
+	if p.tempDir, err = os.MkdirTemp("", "promote"); err != nil {
+		return fmt.Errorf("failed to create chart directory: %w", err)
+	}
+	chartFile, err := chartutil.Save(source.Chart, p.tempDir)
+	if err != nil {
+		return fmt.Errorf("failed to save chart: %w", err)
+	}
+	valuesFile, err := p.writeValues(source.Config)
+	if err != nil {
+		return err
+	}
+
+	cfg := p.cfg
+	cfg.Chart = chartFile
+	cfg.ChartVersion = ""
+	cfg.ValuesFiles = append([]string{valuesFile}, p.cfg.ValuesFiles...)
+
+	p.upgrade = NewUpgrade(cfg)
+	if err := p.upgrade.Prepare(); err != nil {
+		return err
+	}
+	return p.upgrade.Execute()
+}
+
+// writeValues writes the values that were supplied to the source release. The file is private to the plugin's user,
+// since values often include secrets.
+func (p *Promote) writeValues(values map[string]interface{}) (string, error) {
+	contents, err := yaml.Marshal(values)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode values: %w", err)
+	}
+	file, err := os.CreateTemp(p.tempDir, "values*.yaml")
+	if err != nil {
+		return "", fmt.Errorf("failed to create values file: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(contents); err != nil {
+		return "", fmt.Errorf("failed to write values file: %w", err)
+	}
+	return file.Name(), nil
+}
+
+// Cleanup removes the saved chart and values, along with the upgrade's temporary files.
+func (p *Promote) Cleanup() error {
+	if p.upgrade != nil {
+		if err := p.upgrade.Cleanup(); err != nil {
+			return err
+		}
+	}
+	if p.tempDir == "" {
+		return nil
+	}
+	if p.debug {
+		fmt.Fprintf(p.stderr, "removing %s\n", p.tempDir)
+	}
+	return os.RemoveAll(p.tempDir)
+}
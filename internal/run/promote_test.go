@@ -0,0 +1,121 @@
+package run
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/stretchr/testify/suite"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/release"
+)
+
+type PromoteTestSuite struct {
+	suite.Suite
+	ctrl               *gomock.Controller
+	mockCmd            *Mockcmd
+	originalCommand    func(string, ...string) cmd
+	originalGetRelease func(releaseSource, action.DebugLog) (*release.Release, error)
+}
+
+func (suite *PromoteTestSuite) BeforeTest(_, _ string) {
+	suite.ctrl = gomock.NewController(suite.T())
+	suite.mockCmd = NewMockcmd(suite.ctrl)
+
+	suite.originalCommand = command
+	command = func(path string, args ...string) cmd { return suite.mockCmd }
+	suite.originalGetRelease = getRelease
+}
+
+func (suite *PromoteTestSuite) AfterTest(_, _ string) {
+	command = suite.originalCommand
+	getRelease = suite.originalGetRelease
+}
+
+func TestPromoteTestSuite(t *testing.T) {
+	suite.Run(t, new(PromoteTestSuite))
+}
+
+func (suite *PromoteTestSuite) TestNewPromoteDefaultsToTarget() {
+	p := NewPromote(env.Config{Release: "gazette", Namespace: "production", SourceNamespace: "staging"}, "/root/.kube/config")
+	suite.Equal(releaseSource{kubeConfig: "/root/.kube/config", namespace: "staging", name: "gazette"}, p.source)
+}
+
+func (suite *PromoteTestSuite) TestPrepare() {
+	p := NewPromote(env.Config{SourceNamespace: "staging"}, "")
+	suite.EqualError(p.Prepare(), "release is required")
+
+	p = NewPromote(env.Config{Release: "gazette", Namespace: "production"}, "")
+	suite.EqualError(p.Prepare(), "source_release or source_namespace must point to a different release than the target")
+
+	p = NewPromote(env.Config{Release: "gazette", Namespace: "production", SourceKubeContext: "staging"}, "")
+	suite.NoError(p.Prepare())
+}
+
+func (suite *PromoteTestSuite) TestExecute() {
+	defer suite.ctrl.Finish()
+
+	p := NewPromote(env.Config{
+		Release:         "gazette",
+		Namespace:       "production",
+		SourceNamespace: "staging",
+		ValuesFiles:     []string{"./values-production.yml"},
+		Values:          env.ValueList{"replicas=3"},
+		Stdout:          &strings.Builder{},
+	}, "/root/.kube/config")
+
+	getRelease = func(source releaseSource, _ action.DebugLog) (*release.Release, error) {
+		suite.Equal(releaseSource{kubeConfig: "/root/.kube/config", namespace: "staging", name: "gazette"}, source)
+		return &release.Release{
+			Name:    "gazette",
+			Version: 7,
+			Config:  map[string]interface{}{"image": map[string]interface{}{"tag": "1.4.2"}},
+			Chart: &chart.Chart{
+				Metadata:  &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "newspaper", Version: "2.1.0"},
+				Templates: []*chart.File{{Name: "templates/configmap.yaml", Data: []byte("kind: ConfigMap\n")}},
+			},
+		}, nil
+	}
+
+	var args []string
+	command = func(path string, a ...string) cmd {
+		args = a
+		return suite.mockCmd
+	}
+	suite.mockCmd.EXPECT().Stdout(gomock.Any())
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+	suite.mockCmd.EXPECT().Run()
+
+	suite.Require().NoError(p.Prepare())
+	suite.Require().NoError(p.Execute())
+
+	chartFile := args[len(args)-1]
+	suite.True(strings.HasSuffix(chartFile, "newspaper-2.1.0.tgz"), "the stored chart should be deployed")
+	suite.Equal("gazette", args[len(args)-2])
+	suite.Contains(args, "replicas=3")
+	suite.NotContains(args, "--version")
+
+	valuesFlags := p.upgrade.valuesFiles.flags()
+	suite.Require().Len(valuesFlags, 4)
+	suite.Equal("./values-production.yml", valuesFlags[3], "the target's values files should override the source's values")
+	sourceValues, err := os.ReadFile(valuesFlags[1])
+	suite.Require().NoError(err)
+	suite.Equal("image:\n  tag: 1.4.2\n", string(sourceValues))
+
+	suite.Require().NoError(p.Cleanup())
+	_, err = os.Stat(chartFile)
+	suite.True(os.IsNotExist(err), "cleanup should remove the saved chart")
+}
+
+func (suite *PromoteTestSuite) TestExecuteMissingSource() {
+	p := NewPromote(env.Config{Release: "gazette", Namespace: "production", SourceNamespace: "staging"}, "")
+	getRelease = func(releaseSource, action.DebugLog) (*release.Release, error) {
+		return nil, errors.New("release: not found")
+	}
+
+	suite.EqualError(p.Execute(), "could not read release gazette in namespace staging: release: not found")
+}
@@ -78,3 +78,17 @@ func (rc *repoCerts) flags() []string {
 
 	return flags
 }
+
+// cleanup removes the certificate files.
+func (rc *repoCerts) cleanup() error {
+	for _, filename := range []string{rc.certFilename, rc.caCertFilename} {
+		if filename == "" {
+			continue
+		}
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove certificate file: %w", err)
+		}
+	}
+	rc.certFilename, rc.caCertFilename = "", ""
+	return nil
+}
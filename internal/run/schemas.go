@@ -0,0 +1,225 @@
+package run
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/xeipuuv/gojsonschema"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// defaultKubeVersion is the Kubernetes version whose schemas are bundled in the plugin's image
+	defaultKubeVersion = "1.27.0"
+	// defaultSchemaLocation is where the plugin's image keeps the bundled schemas
+	defaultSchemaLocation = "/etc/drone-helm3/schemas"
+)
+
+// schemaValidator checks rendered resources against Kubernetes' JSON schemas, which it reads from schema_location in
+// the layout of https://github.com/yannh/kubernetes-json-schema, and against the schemas of the CRDs in a chart's
+// crds/ folder.
+type schemaValidator struct {
+	kubeVersion string
+	location    string
+	schemas     map[string]*gojsonschema.Schema
+}
+
+// schemaError is a rendered resource that doesn't match its schema
+type schemaError struct {
+	resource string
+	field    string
+	message  string
+}
+
+// newSchemaValidator returns nil when validate_schemas isn't set.
+func newSchemaValidator(cfg env.Config) *schemaValidator {
+	if !cfg.ValidateSchemas {
+		return nil
+	}
+	validator := &schemaValidator{
+		kubeVersion: strings.TrimPrefix(cfg.KubeVersion, "v"),
+		location:    cfg.SchemaLocation,
+		schemas:     make(map[string]*gojsonschema.Schema),
+	}
+	if validator.kubeVersion == "" {
+		validator.kubeVersion = defaultKubeVersion
+	}
+	if strings.Count(validator.kubeVersion, ".") == 1 {
+		validator.kubeVersion += ".0"
+	}
+	if validator.location == "" {
+		validator.location = defaultSchemaLocation
+	}
+	return validator
+}
+
+// prepare makes sure there are schemas for kube_version. It does nothing when validate_schemas isn't set.
+func (v *schemaValidator) prepare() error {
+	if v == nil {
+		return nil
+	}
+	if _, err := os.Stat(v.dir()); err != nil {
+		return fmt.Errorf("no schemas for Kubernetes %s in %s; schema_location needs a %s folder", v.kubeVersion, v.location,
+			filepath.Base(v.dir()))
+	}
+	return nil
+}
+
+func (v *schemaValidator) dir() string {
+	return filepath.Join(v.location, fmt.Sprintf("v%s-standalone-strict", v.kubeVersion))
+}
+
+// validate checks every resource in the manifest the chart rendered, and prints any errors. Resources with no known
+// schema are skipped with a warning.
+func (v *schemaValidator) validate(chart, manifest string, stderr io.Writer) error {
+	crds, err := crdSchemas(chart)
+	if err != nil {
+		return err
+	}
+
+	var errs []schemaError
+	invalid := 0
+	for _, doc := range sortedManifests(manifest) {
+		var resource map[string]interface{}
+		if err := yaml.Unmarshal([]byte(doc), &resource); err != nil {
+			return fmt.Errorf("while parsing rendered chart: %w", err)
+		}
+		apiVersion, _ := resource["apiVersion"].(string)
+		kind, _ := resource["kind"].(string)
+		if kind == "" {
+			continue
+		}
+		metadata, _ := resource["metadata"].(map[string]interface{})
+		name, _ := metadata["name"].(string)
+		id := kind + "/" + name
+
+		resourceSchema := crds[apiVersion+"/"+kind]
+		if resourceSchema == nil {
+			if resourceSchema, err = v.kubeSchema(apiVersion, kind); err != nil {
+				return err
+			}
+		}
+		if resourceSchema == nil {
+			fmt.Fprintf(stderr, "Warning: no schema for %s %s, so %s wasn't validated\n", apiVersion, kind, id)
+			continue
+		}
+
+		result, err := resourceSchema.Validate(gojsonschema.NewGoLoader(resource))
+		if err != nil {
+			return fmt.Errorf("could not validate %s: %w", id, err)
+		}
+		if !result.Valid() {
+			invalid++
+		}
+		for _, resultErr := range result.Errors() {
+			errs = append(errs, schemaError{resource: id, field: resultErr.Field(), message: resultErr.Description()})
+		}
+	}
+
+	if invalid == 0 {
+		return nil
+	}
+	fmt.Fprintf(stderr, "Schema errors in %s:\n", chart)
+	for _, e := range errs {
+		fmt.Fprintf(stderr, "  %s: %s: %s\n", e.resource, e.field, e.message)
+	}
+	return fmt.Errorf("%d resource(s) in %s don't match their schemas", invalid, chart)
+}
+
+// kubeSchema returns the bundled schema for a built-in kind, or nil if there isn't one. The schema files are named
+// like deployment-apps-v1.json, or service-v1.json for the core group.
+func (v *schemaValidator) kubeSchema(apiVersion, kind string) (*gojsonschema.Schema, error) {
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return nil, nil
+	}
+	name := strings.ToLower(kind)
+	if gv.Group != "" {
+		name += "-" + strings.ToLower(strings.Split(gv.Group, ".")[0])
+	}
+	filename := filepath.Join(v.dir(), name+"-"+strings.ToLower(gv.Version)+".json")
+
+	if cached, ok := v.schemas[filename]; ok {
+		return cached, nil
+	}
+	contents, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		v.schemas[filename] = nil
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read schema: %w", err)
+	}
+	loaded, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(contents))
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema %s: %w", filename, err)
+	}
+	v.schemas[filename] = loaded
+	return loaded, nil
+}
+
+// crdSchemas returns the schemas of the custom resources defined in the chart's crds/ folder and those of its
+// subcharts, keyed by apiVersion/kind.
+func crdSchemas(chartPath string) (map[string]*gojsonschema.Schema, error) {
+	chart, err := loader.Load(chartPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not load chart %s: %w", chartPath, err)
+	}
+
+	schemas := make(map[string]*gojsonschema.Schema)
+	for _, file := range chart.CRDs() {
+		for _, doc := range releaseutil.SplitManifests(string(file.Data)) {
+			var crd struct {
+				Spec struct {
+					Group string `json:"group"`
+					Names struct {
+						Kind string `json:"kind"`
+					} `json:"names"`
+					Versions []struct {
+						Name   string `json:"name"`
+						Schema struct {
+							OpenAPIV3Schema map[string]interface{} `json:"openAPIV3Schema"`
+						} `json:"schema"`
+					} `json:"versions"`
+					// apiextensions.k8s.io/v1beta1 CRDs can have one schema for all versions
+					Version    string `json:"version"`
+					Validation struct {
+						OpenAPIV3Schema map[string]interface{} `json:"openAPIV3Schema"`
+					} `json:"validation"`
+				} `json:"spec"`
+			}
+			if err := yaml.Unmarshal([]byte(doc), &crd); err != nil {
+				return nil, fmt.Errorf("could not parse %s: %w", file.Name, err)
+			}
+
+			versions := make(map[string]map[string]interface{})
+			if crd.Spec.Version != "" {
+				versions[crd.Spec.Version] = crd.Spec.Validation.OpenAPIV3Schema
+			}
+			for _, version := range crd.Spec.Versions {
+				versions[version.Name] = version.Schema.OpenAPIV3Schema
+				if versions[version.Name] == nil {
+					versions[version.Name] = crd.Spec.Validation.OpenAPIV3Schema
+				}
+			}
+
+			for version, openAPISchema := range versions {
+				if openAPISchema == nil {
+					continue
+				}
+				loaded, err := gojsonschema.NewSchema(gojsonschema.NewGoLoader(openAPISchema))
+				if err != nil {
+					return nil, fmt.Errorf("invalid schema in %s: %w", file.Name, err)
+				}
+				schemas[crd.Spec.Group+"/"+version+"/"+crd.Spec.Names.Kind] = loaded
+			}
+		}
+	}
+	return schemas, nil
+}
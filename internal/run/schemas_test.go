@@ -0,0 +1,136 @@
+package run
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const serviceSchema = `{
+	"type": "object",
+	"properties": {
+		"apiVersion": {"type": "string"},
+		"kind": {"type": "string"},
+		"metadata": {"type": "object"},
+		"spec": {
+			"type": "object",
+			"properties": {
+				"ports": {"type": "array", "items": {"type": "object", "properties": {"port": {"type": "integer"}}}}
+			},
+			"additionalProperties": false
+		}
+	},
+	"additionalProperties": false
+}`
+
+const widgetCRD = `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+spec:
+  group: example.com
+  names:
+    kind: Widget
+  versions:
+  - name: v1
+    schema:
+      openAPIV3Schema:
+        type: object
+        properties:
+          spec:
+            type: object
+            required: [size]
+            properties:
+              size:
+                type: integer
+`
+
+// schemaFixtures writes a schema location with a schema for services, and a chart that defines widgets
+func schemaFixtures(t *testing.T) (location, chart string) {
+	location = t.TempDir()
+	dir := filepath.Join(location, "v1.27.0-standalone-strict")
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "service-v1.json"), []byte(serviceSchema), 0644))
+
+	chart = t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(chart, "Chart.yaml"), []byte("apiVersion: v2\nname: widgets\nversion: 1.0.0\n"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(chart, "crds"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(chart, "crds", "widget.yaml"), []byte(widgetCRD), 0644))
+	return location, chart
+}
+
+func TestNewSchemaValidator(t *testing.T) {
+	assert.Nil(t, newSchemaValidator(env.Config{}))
+
+	v := newSchemaValidator(env.Config{ValidateSchemas: true})
+	assert.Equal(t, defaultKubeVersion, v.kubeVersion)
+	assert.Equal(t, defaultSchemaLocation, v.location)
+
+	v = newSchemaValidator(env.Config{ValidateSchemas: true, KubeVersion: "v1.25", SchemaLocation: "/schemas"})
+	assert.Equal(t, "1.25.0", v.kubeVersion)
+	assert.EqualError(t, v.prepare(), "no schemas for Kubernetes 1.25.0 in /schemas; schema_location needs a v1.25.0-standalone-strict folder")
+
+	var disabled *schemaValidator
+	assert.NoError(t, disabled.prepare())
+}
+
+func TestValidateSchemas(t *testing.T) {
+	location, chart := schemaFixtures(t)
+	v := newSchemaValidator(env.Config{ValidateSchemas: true, KubeVersion: "1.27", SchemaLocation: location})
+	require.NoError(t, v.prepare())
+
+	valid := `---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+spec:
+  ports:
+  - port: 80
+---
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: gear
+spec:
+  size: 3
+`
+	stderr := &strings.Builder{}
+	assert.NoError(t, v.validate(chart, valid, stderr))
+	assert.Empty(t, stderr.String())
+
+	invalid := `---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+spec:
+  ports:
+  - port: "eighty"
+  clusterIp: None
+---
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: gear
+spec: {}
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+`
+	stderr.Reset()
+	err := v.validate(chart, invalid, stderr)
+	assert.EqualError(t, err, "2 resource(s) in "+chart+" don't match their schemas")
+	assert.Equal(t, "Warning: no schema for v1 ConfigMap, so ConfigMap/settings wasn't validated\n"+
+		"Schema errors in "+chart+":\n"+
+		"  Service/web: spec: Additional property clusterIp is not allowed\n"+
+		"  Service/web: spec.ports.0.port: Invalid type. Expected: integer, given: string\n"+
+		"  Widget/gear: spec: size is required\n", stderr.String())
+}
@@ -0,0 +1,43 @@
+package run
+
+import (
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+)
+
+// setValues holds the chart values that are passed with helm's --set family of flags. Each entry gets a flag of its
+// own, so helm never has to split one entry from the next.
+type setValues struct {
+	values       []string
+	stringValues []string
+	jsonValues   []string
+	files        []string
+}
+
+func newSetValues(cfg env.Config) *setValues {
+	return &setValues{
+		values:       cfg.Values,
+		stringValues: cfg.StringValues,
+		jsonValues:   cfg.SetJSON,
+		files:        cfg.SetFile,
+	}
+}
+
+func (sv *setValues) flags() []string {
+	flags := make([]string, 0)
+	for _, set := range []struct {
+		flag    string
+		entries []string
+	}{
+		{"--set", sv.values},
+		{"--set-string", sv.stringValues},
+		{"--set-json", sv.jsonValues},
+		{"--set-file", sv.files},
+	} {
+		for _, entry := range set.entries {
+			if entry != "" {
+				flags = append(flags, set.flag, entry)
+			}
+		}
+	}
+	return flags
+}
@@ -0,0 +1,37 @@
+package run
+
+import (
+	"testing"
+
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/stretchr/testify/suite"
+)
+
+type SetValuesTestSuite struct {
+	suite.Suite
+}
+
+func TestSetValuesTestSuite(t *testing.T) {
+	suite.Run(t, new(SetValuesTestSuite))
+}
+
+func (suite *SetValuesTestSuite) TestFlags() {
+	sv := newSetValues(env.Config{
+		Values:       env.ValueList{"tempo=allegro", `tempi=allegro\,adagio`},
+		StringValues: env.ValueList{"opus=27"},
+		SetJSON:      env.JSONValueList{`movements=["adagio","allegretto","presto"]`},
+		SetFile:      env.ValueList{"score=./moonlight.txt"},
+	})
+
+	suite.Equal([]string{
+		"--set", "tempo=allegro",
+		"--set", `tempi=allegro\,adagio`,
+		"--set-string", "opus=27",
+		"--set-json", `movements=["adagio","allegretto","presto"]`,
+		"--set-file", "score=./moonlight.txt",
+	}, sv.flags())
+}
+
+func (suite *SetValuesTestSuite) TestNoFlags() {
+	suite.Empty(newSetValues(env.Config{}).flags())
+}
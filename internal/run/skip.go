@@ -0,0 +1,33 @@
+package run
+
+import (
+	"fmt"
+
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+)
+
+// Skip is a step in a helm Plan that does nothing, for Drone events that aren't mapped to a mode when
+// skip_unmapped_events is set.
+type Skip struct {
+	*config
+	event string
+}
+
+// NewSkip creates a Skip using fields from the given Config.
+func NewSkip(cfg env.Config) *Skip {
+	return &Skip{
+		config: newConfig(cfg),
+		event:  cfg.DroneEvent,
+	}
+}
+
+// Prepare does nothing.
+func (s *Skip) Prepare() error {
+	return nil
+}
+
+// Execute reports that there's nothing to do.
+func (s *Skip) Execute() error {
+	fmt.Fprintf(s.stdout, "Nothing to do for the '%s' event\n", s.event)
+	return nil
+}
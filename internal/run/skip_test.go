@@ -0,0 +1,26 @@
+package run
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/stretchr/testify/suite"
+)
+
+type SkipTestSuite struct {
+	suite.Suite
+}
+
+func TestSkipTestSuite(t *testing.T) {
+	suite.Run(t, new(SkipTestSuite))
+}
+
+func (suite *SkipTestSuite) TestExecute() {
+	stdout := &strings.Builder{}
+	skip := NewSkip(env.Config{DroneEvent: "cron", Stdout: stdout})
+
+	suite.Require().NoError(skip.Prepare())
+	suite.Require().NoError(skip.Execute())
+	suite.Equal("Nothing to do for the 'cron' event\n", stdout.String())
+}
@@ -15,9 +15,8 @@ type Upgrade struct {
 	chartVersion    string
 	dryRun          bool
 	wait            bool
-	values          string
-	stringValues    string
-	valuesFiles     []string
+	setValues       *setValues
+	valuesFiles     *valuesFiles
 	reuseValues     bool
 	timeout         string
 	force           bool
@@ -27,10 +26,22 @@ type Upgrade struct {
 	certs           *repoCerts
 	createNamespace bool
 	skipCrds        bool
+	build           *buildInfo
+	onFailure       *failureHandler
 
 	cmd cmd
 }
 
+// buildInfo describes the Drone build that's deploying a release, for inject_build_metadata.
+type buildInfo struct {
+	prefix      string
+	commit      string
+	buildNumber string
+	repo        string
+	branch      string
+	tag         string
+}
+
 // NewUpgrade creates an Upgrade using fields from the given Config. No validation is performed at this time.
 func NewUpgrade(cfg env.Config) *Upgrade {
 	return &Upgrade{
@@ -40,9 +51,8 @@ func NewUpgrade(cfg env.Config) *Upgrade {
 		chartVersion:    cfg.ChartVersion,
 		dryRun:          cfg.DryRun,
 		wait:            cfg.Wait,
-		values:          cfg.Values,
-		stringValues:    cfg.StringValues,
-		valuesFiles:     cfg.ValuesFiles,
+		setValues:       newSetValues(cfg),
+		valuesFiles:     newValuesFiles(cfg),
 		reuseValues:     cfg.ReuseValues,
 		timeout:         cfg.Timeout,
 		force:           cfg.Force,
@@ -52,12 +62,37 @@ func NewUpgrade(cfg env.Config) *Upgrade {
 		certs:           newRepoCerts(cfg),
 		createNamespace: cfg.CreateNamespace,
 		skipCrds:        cfg.SkipCrds,
+		build:           newBuildInfo(cfg),
+		onFailure:       newFailureHandler(cfg),
+	}
+}
+
+func newBuildInfo(cfg env.Config) *buildInfo {
+	if !cfg.InjectBuildMetadata {
+		return nil
+	}
+	return &buildInfo{
+		prefix:      cfg.BuildMetadataPrefix,
+		commit:      cfg.Commit,
+		buildNumber: cfg.BuildNumber,
+		repo:        cfg.Repo,
+		branch:      cfg.Branch,
+		tag:         cfg.Tag,
 	}
 }
 
-// Execute executes the `helm upgrade` command.
+// Execute executes the `helm upgrade` command. If it fails, the on_failure actions are run.
 func (u *Upgrade) Execute() error {
-	return u.cmd.Run()
+	err := u.cmd.Run()
+	if err != nil && u.onFailure != nil {
+		return u.onFailure.handle(err)
+	}
+	return err
+}
+
+// Cleanup removes any temporary values files.
+func (u *Upgrade) Cleanup() error {
+	return u.valuesFiles.cleanup()
 }
 
 // Prepare gets the Upgrade ready to execute.
@@ -68,6 +103,13 @@ func (u *Upgrade) Prepare() error {
 	if u.release == "" {
 		return fmt.Errorf("release is required")
 	}
+	if err := u.onFailure.prepare(); err != nil {
+		return err
+	}
+
+	if err := u.valuesFiles.write(); err != nil {
+		return err
+	}
 
 	args := u.globalFlags()
 	args = append(args, "upgrade", "--install")
@@ -96,22 +138,16 @@ func (u *Upgrade) Prepare() error {
 	if u.cleanupOnFail {
 		args = append(args, "--cleanup-on-fail")
 	}
-	if u.values != "" {
-		args = append(args, "--set", u.values)
-	}
-	if u.stringValues != "" {
-		args = append(args, "--set-string", u.stringValues)
-	}
+	args = append(args, u.setValues.flags()...)
 	if u.createNamespace {
 		args = append(args, "--create-namespace")
 	}
 	if u.skipCrds {
 		args = append(args, "--skip-crds")
 	}
-	for _, vFile := range u.valuesFiles {
-		args = append(args, "--values", vFile)
-	}
+	args = append(args, u.valuesFiles.flags()...)
 	args = append(args, u.certs.flags()...)
+	args = append(args, u.build.flags()...)
 
 	// always set --history-max since it defaults to non-zero value
 	args = append(args, fmt.Sprintf("--history-max=%d", u.historyMax))
@@ -127,3 +163,45 @@ func (u *Upgrade) Prepare() error {
 
 	return nil
 }
+
+// flags passes the build's details as string values, so they're available to the chart, and as the release's
+// description, so they show up in `helm history`. Each value gets its own --set-string, since branch and tag names can
+// contain characters that are special to helm.
+func (b *buildInfo) flags() []string {
+	if b == nil {
+		return nil
+	}
+
+	flags := make([]string, 0)
+	for _, value := range []struct{ key, value string }{
+		{"commitSha", b.commit},
+		{"buildNumber", b.buildNumber},
+		{"repo", b.repo},
+		{"branch", b.branch},
+		{"tag", b.tag},
+	} {
+		if value.value == "" {
+			continue
+		}
+		key := value.key
+		if b.prefix != "" {
+			key = b.prefix + "." + key
+		}
+		flags = append(flags, "--set-string", key+"="+env.EscapeValue(value.value))
+	}
+
+	return append(flags, "--description", b.description())
+}
+
+func (b *buildInfo) description() string {
+	description := fmt.Sprintf("Drone build %s of %s", b.buildNumber, b.repo)
+	if b.commit != "" {
+		description += fmt.Sprintf(", commit %s", b.commit)
+	}
+	if b.tag != "" {
+		description += fmt.Sprintf(", tag %s", b.tag)
+	} else if b.branch != "" {
+		description += fmt.Sprintf(", branch %s", b.branch)
+	}
+	return description
+}
@@ -38,8 +38,8 @@ func (suite *UpgradeTestSuite) TestNewUpgrade() {
 	cfg.ChartVersion = "seventeen"
 	cfg.DryRun = true
 	cfg.Wait = true
-	cfg.Values = "steadfastness,forthrightness"
-	cfg.StringValues = "tensile_strength,flexibility"
+	cfg.Values = env.ValueList{"steadfastness,forthrightness"}
+	cfg.StringValues = env.ValueList{"tensile_strength,flexibility"}
 	cfg.ValuesFiles = []string{"/root/price_inventory.yml"}
 	cfg.ReuseValues = true
 	cfg.Timeout = "go sit in the corner"
@@ -56,9 +56,9 @@ func (suite *UpgradeTestSuite) TestNewUpgrade() {
 	suite.Equal(cfg.ChartVersion, up.chartVersion)
 	suite.Equal(true, up.dryRun)
 	suite.Equal(cfg.Wait, up.wait)
-	suite.Equal("steadfastness,forthrightness", up.values)
-	suite.Equal("tensile_strength,flexibility", up.stringValues)
-	suite.Equal([]string{"/root/price_inventory.yml"}, up.valuesFiles)
+	suite.Equal([]string{"steadfastness,forthrightness"}, up.setValues.values)
+	suite.Equal([]string{"tensile_strength,flexibility"}, up.setValues.stringValues)
+	suite.Equal([]string{"/root/price_inventory.yml"}, up.valuesFiles.files)
 	suite.Equal(cfg.ReuseValues, up.reuseValues)
 	suite.Equal(cfg.Timeout, up.timeout)
 	suite.Equal(cfg.Force, up.force)
@@ -131,8 +131,8 @@ func (suite *UpgradeTestSuite) TestPrepareWithUpgradeFlags() {
 	cfg.ChartVersion = "radio_edit"
 	cfg.DryRun = true
 	cfg.Wait = true
-	cfg.Values = "age=35"
-	cfg.StringValues = "height=5ft10in"
+	cfg.Values = env.ValueList{"age=35"}
+	cfg.StringValues = env.ValueList{"height=5ft10in"}
 	cfg.ValuesFiles = []string{"/usr/local/stats", "/usr/local/grades"}
 	cfg.ReuseValues = true
 	cfg.Timeout = "sit_in_the_corner"
@@ -251,3 +251,35 @@ func (suite *UpgradeTestSuite) TestPrepareSkipCrdsFlag() {
 	err := u.Prepare()
 	suite.Require().Nil(err)
 }
+
+func (suite *UpgradeTestSuite) TestPrepareWithBuildMetadata() {
+	defer suite.ctrl.Finish()
+
+	cfg := env.NewTestConfig(suite.T())
+	cfg.Chart = "at40"
+	cfg.Release = "lizzo_good_as_hell"
+	cfg.InjectBuildMetadata = true
+	cfg.Commit = "5e1f1e5"
+	cfg.BuildNumber = "42"
+	cfg.Repo = "octocat/charts"
+	cfg.Branch = "feature/a,b"
+	cfg.Tag = ""
+
+	u := NewUpgrade(*cfg)
+
+	command = func(path string, args ...string) cmd {
+		suite.Equal([]string{"upgrade", "--install",
+			"--set-string", "drone.commitSha=5e1f1e5",
+			"--set-string", "drone.buildNumber=42",
+			"--set-string", "drone.repo=octocat/charts",
+			"--set-string", `drone.branch=feature/a\,b`,
+			"--description", "Drone build 42 of octocat/charts, commit 5e1f1e5, branch feature/a,b",
+			"--history-max=10", "lizzo_good_as_hell", "at40"}, args)
+
+		return suite.mockCmd
+	}
+	suite.mockCmd.EXPECT().Stdout(gomock.Any())
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+
+	suite.Require().NoError(u.Prepare())
+}
@@ -0,0 +1,178 @@
+package run
+
+import (
+	ctx "context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// tillerName is the name of the deployment and service that `helm init` creates for Tiller
+const tillerName = "tiller-deploy"
+
+// V2Cleanup is an execution step that removes the helm v2 release versions that conversion kept, once their
+// retention period is over, and optionally Tiller itself. It never removes a release that doesn't have a deployed v3
+// counterpart.
+type V2Cleanup struct {
+	*config
+	convert      *Convert
+	retention    string
+	keepFor      time.Duration
+	deleteTiller bool
+	dryRun       bool
+}
+
+// NewV2Cleanup creates a V2Cleanup using fields from the given Config. No validation is performed at this time.
+func NewV2Cleanup(cfg env.Config, kubeConfig string, kubeContext string) *V2Cleanup {
+	// the cleanup looks at every release in the Tiller namespace, the same way convert_all does
+	convertCfg := cfg
+	convertCfg.ConvertAll = true
+	convertCfg.ConvertInclude, convertCfg.ConvertExclude = nil, nil
+
+	return &V2Cleanup{
+		config:       newConfig(cfg),
+		convert:      NewConvert(convertCfg, kubeConfig, kubeContext),
+		retention:    cfg.V2Retention,
+		deleteTiller: cfg.DeleteTiller,
+		dryRun:       cfg.DryRun,
+	}
+}
+
+// Prepare checks the retention period and Tiller settings.
+func (v *V2Cleanup) Prepare() error {
+	if err := v.convert.Prepare(); err != nil {
+		return err
+	}
+	if v.convert.storage == localStorage {
+		return fmt.Errorf("v2-cleanup can't remove releases when tiller_storage is '%s'", localStorage)
+	}
+	// removing v2 releases can't be undone, so an immediate removal has to be asked for
+	if v.retention == "" {
+		return fmt.Errorf("v2_retention is required, e.g. 720h, or 0s to remove converted releases straight away")
+	}
+	keepFor, err := time.ParseDuration(v.retention)
+	if err != nil {
+		return fmt.Errorf("invalid v2_retention: %w", err)
+	}
+	v.keepFor = keepFor
+	if v.deleteTiller && v.convert.convertOptions.TillerNamespace == "" {
+		return fmt.Errorf("tiller_ns or namespace is required to delete Tiller")
+	}
+	return nil
+}
+
+// Execute removes the converted v2 release versions, then Tiller if delete_tiller is set.
+func (v *V2Cleanup) Execute() error {
+	clientset, err := clientsetFromFile(v.convert.kubeConfig, v.convert.cluster)
+	if err != nil {
+		return err
+	}
+
+	return v.clean(clientset, v.convert.actions())
+}
+
+// clean removes the converted versions of each v2 release whose v3 counterpart is deployed. Release names are only
+// unique within a namespace, so the counterpart is looked for in the namespace the v2 release was installed in, with
+// the action configuration for that namespace.
+func (v *V2Cleanup) clean(clientset kubernetes.Interface, actions actionsFor) error {
+	converted, err := v.convert.listV2Releases(clientset, v.convert.preserveLabel)
+	if err != nil {
+		return err
+	}
+
+	byRelease := make(map[string][]metav1.ObjectMeta)
+	for _, version := range converted {
+		byRelease[version.Labels["NAME"]] = append(byRelease[version.Labels["NAME"]], version)
+	}
+	releases := make([]string, 0, len(byRelease))
+	for release := range byRelease {
+		releases = append(releases, release)
+	}
+	sort.Strings(releases)
+
+	now := time.Now()
+	refused := 0
+	for _, release := range releases {
+		actionCfg, err := actions(v.convert.v3Namespace(clientset, byRelease[release]))
+		if err != nil {
+			return err
+		}
+		if !v3ReleaseDeployed(release, actionCfg) {
+			fmt.Fprintf(v.stderr, "Warning: keeping v2 release %s, since it has no deployed v3 release\n", release)
+			refused++
+			continue
+		}
+		for _, version := range byRelease[release] {
+			if now.Sub(convertedAt(version)) < v.keepFor {
+				continue
+			}
+			if err := v.remove(clientset, version.Name); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !v.deleteTiller {
+		return nil
+	}
+	unconverted, err := v.convert.listV2Releases(clientset, v.convert.tillerLabel)
+	if err != nil {
+		return err
+	}
+	if refused > 0 || len(unconverted) > 0 {
+		fmt.Fprintf(v.stderr, "Warning: not deleting Tiller, since some of its releases haven't been converted to v3\n")
+		return nil
+	}
+	return v.removeTiller(clientset)
+}
+
+// convertedAt is when a v2 release version was relabelled. Versions relabelled before the time was recorded fall back
+// to when they were created, which is never later.
+func convertedAt(version metav1.ObjectMeta) time.Time {
+	if at, err := time.Parse(time.RFC3339, version.Annotations[convertedAtAnnotation]); err == nil {
+		return at
+	}
+	return version.CreationTimestamp.Time
+}
+
+func (v *V2Cleanup) remove(clientset kubernetes.Interface, name string) error {
+	fmt.Fprintf(v.stdout, "Removing v2 release version %s\n", name)
+	if v.dryRun {
+		return nil
+	}
+
+	tillerNamespace := v.convert.convertOptions.TillerNamespace
+	var err error
+	if v.convert.storage == secretStorage {
+		err = clientset.CoreV1().Secrets(tillerNamespace).Delete(ctx.Background(), name, metav1.DeleteOptions{})
+	} else {
+		err = clientset.CoreV1().ConfigMaps(tillerNamespace).Delete(ctx.Background(), name, metav1.DeleteOptions{})
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("could not remove v2 release version %s: %w", name, err)
+	}
+	return nil
+}
+
+func (v *V2Cleanup) removeTiller(clientset kubernetes.Interface) error {
+	tillerNamespace := v.convert.convertOptions.TillerNamespace
+	fmt.Fprintf(v.stdout, "Deleting Tiller from namespace %s\n", tillerNamespace)
+	if v.dryRun {
+		return nil
+	}
+
+	err := clientset.AppsV1().Deployments(tillerNamespace).Delete(ctx.Background(), tillerName, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("could not delete the Tiller deployment: %w", err)
+	}
+	err = clientset.CoreV1().Services(tillerNamespace).Delete(ctx.Background(), tillerName, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("could not delete the Tiller service: %w", err)
+	}
+	return nil
+}
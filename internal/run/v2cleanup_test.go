@@ -0,0 +1,162 @@
+package run
+
+import (
+	ctx "context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/release"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	rspb "k8s.io/helm/pkg/proto/hapi/release"
+)
+
+func convertedV2ReleaseMeta(name, release, version string, convertedAt time.Time) metav1.ObjectMeta {
+	meta := v2ReleaseMeta(name, release, version)
+	meta.Labels["OWNER"] = "converted-to-helm3"
+	meta.Annotations = map[string]string{convertedAtAnnotation: convertedAt.UTC().Format(time.RFC3339)}
+	return meta
+}
+
+func tillerObjects() []runtime.Object {
+	meta := metav1.ObjectMeta{Name: tillerName, Namespace: "example"}
+	return []runtime.Object{&appsv1.Deployment{ObjectMeta: meta}, &corev1.Service{ObjectMeta: meta}}
+}
+
+// actionsWithV3Releases deploys v3 releases in the given namespace
+func actionsWithV3Releases(t *testing.T, namespace string, names ...string) actionsFor {
+	var releases []*release.Release
+	for _, name := range names {
+		releases = append(releases, release.Mock(&release.MockReleaseOptions{Name: name, Namespace: namespace}))
+	}
+	return namespacedActions(t, releases...)
+}
+
+func TestV2CleanupPrepare(t *testing.T) {
+	v := NewV2Cleanup(env.Config{TillerNS: "example", V2Retention: "720h", DeleteTiller: true}, "", "")
+	require.NoError(t, v.Prepare(), "v2-cleanup doesn't need a release")
+	assert.Equal(t, 720*time.Hour, v.keepFor)
+
+	v = NewV2Cleanup(env.Config{TillerNS: "example", V2Retention: "a month"}, "", "")
+	assert.EqualError(t, v.Prepare(), `invalid v2_retention: time: invalid duration "a month"`)
+
+	v = NewV2Cleanup(env.Config{TillerNS: "example"}, "", "")
+	assert.EqualError(t, v.Prepare(), "v2_retention is required, e.g. 720h, or 0s to remove converted releases straight away")
+
+	v = NewV2Cleanup(env.Config{V2Retention: "0s", DeleteTiller: true}, "", "")
+	assert.EqualError(t, v.Prepare(), "tiller_ns or namespace is required to delete Tiller")
+}
+
+func TestV2CleanupRemovesConvertedReleases(t *testing.T) {
+	old := time.Now().Add(-40 * 24 * time.Hour)
+	objects := append(tillerObjects(),
+		&corev1.ConfigMap{ObjectMeta: convertedV2ReleaseMeta("myapp.v1", "myapp", "1", old)},
+		&corev1.ConfigMap{ObjectMeta: convertedV2ReleaseMeta("myapp.v2", "myapp", "2", time.Now())},
+		&corev1.ConfigMap{ObjectMeta: convertedV2ReleaseMeta("orphan.v1", "orphan", "1", old)},
+	)
+	clientset := fake.NewSimpleClientset(objects...)
+	stdout, stderr := &strings.Builder{}, &strings.Builder{}
+
+	v := NewV2Cleanup(env.Config{TillerNS: "example", V2Retention: "720h", DeleteTiller: true, Stdout: stdout, Stderr: stderr}, "", "")
+	require.NoError(t, v.Prepare())
+	require.NoError(t, v.clean(clientset, actionsWithV3Releases(t, "default", "myapp")))
+
+	assert.Equal(t, "Removing v2 release version myapp.v1\n", stdout.String())
+	assert.Equal(t, "Warning: keeping v2 release orphan, since it has no deployed v3 release\n"+
+		"Warning: not deleting Tiller, since some of its releases haven't been converted to v3\n", stderr.String())
+
+	configmaps := clientset.CoreV1().ConfigMaps("example")
+	_, err := configmaps.Get(ctx.Background(), "myapp.v1", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	_, err = configmaps.Get(ctx.Background(), "myapp.v2", metav1.GetOptions{})
+	assert.NoError(t, err, "versions within the retention period should be kept")
+	_, err = configmaps.Get(ctx.Background(), "orphan.v1", metav1.GetOptions{})
+	assert.NoError(t, err, "releases without a v3 counterpart should be kept")
+	_, err = clientset.AppsV1().Deployments("example").Get(ctx.Background(), tillerName, metav1.GetOptions{})
+	assert.NoError(t, err)
+}
+
+func TestV2CleanupLooksForV3ReleaseInItsNamespace(t *testing.T) {
+	meta := convertedV2ReleaseMeta("myapp.v1", "myapp", "1", time.Now())
+	data := encodeV2Release(t, &rspb.Release{Name: "myapp", Namespace: "production", Version: 1})
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{ObjectMeta: meta, Data: map[string]string{"release": data}})
+	stderr := &strings.Builder{}
+
+	v := NewV2Cleanup(env.Config{TillerNS: "example", V2Retention: "0s", Stdout: &strings.Builder{}, Stderr: stderr}, "", "")
+	require.NoError(t, v.Prepare())
+	require.NoError(t, v.clean(clientset, actionsWithV3Releases(t, "staging", "myapp")))
+
+	assert.Equal(t, "Warning: keeping v2 release myapp, since it has no deployed v3 release\n", stderr.String(),
+		"a release with the same name in another namespace is a different release")
+	_, err := clientset.CoreV1().ConfigMaps("example").Get(ctx.Background(), "myapp.v1", metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	require.NoError(t, v.clean(clientset, actionsWithV3Releases(t, "production", "myapp")))
+	_, err = clientset.CoreV1().ConfigMaps("example").Get(ctx.Background(), "myapp.v1", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func TestV2CleanupDeletesTiller(t *testing.T) {
+	objects := append(tillerObjects(),
+		&corev1.Secret{ObjectMeta: convertedV2ReleaseMeta("myapp.v1", "myapp", "1", time.Now())},
+	)
+	clientset := fake.NewSimpleClientset(objects...)
+
+	v := NewV2Cleanup(env.Config{TillerNS: "example", V2Retention: "0s", TillerStorage: secretStorage, DeleteTiller: true, Stdout: &strings.Builder{}}, "", "")
+	require.NoError(t, v.Prepare())
+	require.NoError(t, v.clean(clientset, actionsWithV3Releases(t, "default", "myapp")))
+
+	_, err := clientset.CoreV1().Secrets("example").Get(ctx.Background(), "myapp.v1", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	_, err = clientset.AppsV1().Deployments("example").Get(ctx.Background(), tillerName, metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	_, err = clientset.CoreV1().Services("example").Get(ctx.Background(), tillerName, metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func TestV2CleanupKeepsTillerWithUnconvertedReleases(t *testing.T) {
+	objects := append(tillerObjects(), &corev1.ConfigMap{ObjectMeta: v2ReleaseMeta("legacy.v1", "legacy", "1")})
+	clientset := fake.NewSimpleClientset(objects...)
+	stderr := &strings.Builder{}
+
+	v := NewV2Cleanup(env.Config{TillerNS: "example", V2Retention: "0s", DeleteTiller: true, Stdout: &strings.Builder{}, Stderr: stderr}, "", "")
+	require.NoError(t, v.Prepare())
+	require.NoError(t, v.clean(clientset, actionsWithV3Releases(t, "default")))
+
+	assert.Equal(t, "Warning: not deleting Tiller, since some of its releases haven't been converted to v3\n", stderr.String())
+	_, err := clientset.AppsV1().Deployments("example").Get(ctx.Background(), tillerName, metav1.GetOptions{})
+	assert.NoError(t, err)
+}
+
+func TestV2CleanupDryRun(t *testing.T) {
+	objects := append(tillerObjects(), &corev1.ConfigMap{ObjectMeta: convertedV2ReleaseMeta("myapp.v1", "myapp", "1", time.Now())})
+	clientset := fake.NewSimpleClientset(objects...)
+	stdout := &strings.Builder{}
+
+	v := NewV2Cleanup(env.Config{TillerNS: "example", V2Retention: "0s", DeleteTiller: true, DryRun: true, Stdout: stdout}, "", "")
+	require.NoError(t, v.Prepare())
+	require.NoError(t, v.clean(clientset, actionsWithV3Releases(t, "default", "myapp")))
+
+	assert.Equal(t, "Removing v2 release version myapp.v1\nDeleting Tiller from namespace example\n", stdout.String())
+	_, err := clientset.CoreV1().ConfigMaps("example").Get(ctx.Background(), "myapp.v1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	_, err = clientset.AppsV1().Deployments("example").Get(ctx.Background(), tillerName, metav1.GetOptions{})
+	assert.NoError(t, err)
+}
+
+func TestConvertedAt(t *testing.T) {
+	at := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	assert.Equal(t, at, convertedAt(convertedV2ReleaseMeta("myapp.v1", "myapp", "1", at)))
+
+	meta := v2ReleaseMeta("myapp.v1", "myapp", "1")
+	meta.CreationTimestamp = metav1.NewTime(at)
+	assert.True(t, at.Equal(convertedAt(meta)), "versions without an annotation should fall back to their creation time")
+}
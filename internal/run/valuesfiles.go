@@ -0,0 +1,269 @@
+package run
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	sopsBin = "/usr/local/bin/sops"
+
+	// encryptedMarker is the prefix that marks a values_files entry as SOPS-encrypted
+	encryptedMarker = "sops:"
+	// optionalMarker is the prefix that marks a values_files entry as one that may not exist
+	optionalMarker = "optional:"
+)
+
+// buildMetadata is the data available to placeholders like `{{ .DeployTo }}` in values_files entries.
+type buildMetadata struct {
+	DeployTo string
+	Branch   string
+	Event    string
+}
+
+// valuesFiles prepares the files passed to helm's --values flag. Files that are SOPS-encrypted or contain references
+// to secrets are written to private temporary files, which are removed again by cleanup.
+type valuesFiles struct {
+	*config
+	files     []string
+	filenames []string
+	tempFiles []string
+	metadata  buildMetadata
+	resolve   func(string) (string, error)
+}
+
+func newValuesFiles(cfg env.Config) *valuesFiles {
+	return &valuesFiles{
+		config:  newConfig(cfg),
+		files:   cfg.ValuesFiles,
+		resolve: cfg.ResolveReferences,
+		metadata: buildMetadata{
+			DeployTo: cfg.DeployTo,
+			Branch:   cfg.Branch,
+			Event:    cfg.DroneEvent,
+		},
+	}
+}
+
+// only returns valuesFiles for other entries, which are prepared the same way
+func (vf *valuesFiles) only(files []string) *valuesFiles {
+	other := *vf
+	other.files = files
+	other.filenames, other.tempFiles = nil, nil
+	return &other
+}
+
+func (vf *valuesFiles) write() error {
+	vf.filenames = make([]string, 0, len(vf.files))
+	for _, entry := range vf.files {
+		source, encrypted, optional, err := vf.expand(entry)
+		if err != nil {
+			return err
+		}
+
+		if optional {
+			if _, err := os.Stat(source); os.IsNotExist(err) {
+				if vf.debug {
+					fmt.Fprintf(vf.stderr, "skipping optional values file %s, which doesn't exist\n", source)
+				}
+				continue
+			}
+		}
+
+		var contents []byte
+		if encrypted {
+			if contents, err = vf.decrypt(source); err != nil {
+				return err
+			}
+		} else if contents, err = os.ReadFile(source); err != nil {
+			// not a local file (helm also accepts URLs); let helm deal with it
+			vf.filenames = append(vf.filenames, source)
+			continue
+		}
+
+		resolved, changed, err := vf.resolveReferences(contents)
+		if err != nil {
+			return fmt.Errorf("in values file %s: %w", source, err)
+		}
+		if !encrypted && !changed {
+			vf.filenames = append(vf.filenames, source)
+			continue
+		}
+
+		filename, err := vf.writeTemp(source, resolved)
+		if err != nil {
+			return err
+		}
+		vf.filenames = append(vf.filenames, filename)
+	}
+	return nil
+}
+
+// resolveReferences replaces the references in a values file. Each value is resolved on its own and written back as a
+// YAML string, so whatever a secret contains, it can't change the structure of the file. A value that's nothing but a
+// reference to a number or boolean keeps that type, as it would if it were written out in the file.
+func (vf *valuesFiles) resolveReferences(contents []byte) ([]byte, bool, error) {
+	var docs []*yaml.Node
+	changed := false
+	decoder := yaml.NewDecoder(bytes.NewReader(contents))
+	for {
+		doc := &yaml.Node{}
+		if err := decoder.Decode(doc); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, false, fmt.Errorf("could not parse: %w", err)
+		}
+		docChanged, err := vf.resolveNode(doc)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = changed || docChanged
+		docs = append(docs, doc)
+	}
+	if !changed {
+		return contents, false, nil
+	}
+
+	resolved := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(resolved)
+	encoder.SetIndent(2)
+	for _, doc := range docs {
+		if err := encoder.Encode(doc); err != nil {
+			return nil, false, err
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, false, err
+	}
+	return resolved.Bytes(), true, nil
+}
+
+func (vf *valuesFiles) resolveNode(node *yaml.Node) (bool, error) {
+	if node.Kind != yaml.ScalarNode {
+		changed := false
+		for _, child := range node.Content {
+			childChanged, err := vf.resolveNode(child)
+			if err != nil {
+				return false, err
+			}
+			changed = changed || childChanged
+		}
+		return changed, nil
+	}
+
+	resolved, err := vf.resolve(node.Value)
+	if err != nil || resolved == node.Value {
+		return false, err
+	}
+	node.Value, node.Tag = resolved, "!!str"
+	if node.Style == 0 {
+		node.Tag = plainScalarTag(resolved)
+	}
+	return true, nil
+}
+
+// plainScalarTag is the type of a value written unquoted, if it's a number or boolean, or !!str otherwise.
+func plainScalarTag(value string) string {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(value), &doc); err != nil || len(doc.Content) != 1 {
+		return "!!str"
+	}
+	scalar := doc.Content[0]
+	if scalar.Kind != yaml.ScalarNode || scalar.Value != value {
+		return "!!str"
+	}
+	switch scalar.Tag {
+	case "!!int", "!!float", "!!bool":
+		return scalar.Tag
+	}
+	return "!!str"
+}
+
+// expand strips an entry's markers and fills in its placeholders.
+func (vf *valuesFiles) expand(entry string) (source string, encrypted, optional bool, err error) {
+	source = entry
+	for {
+		if strings.HasPrefix(source, optionalMarker) {
+			source, optional = strings.TrimPrefix(source, optionalMarker), true
+		} else if strings.HasPrefix(source, encryptedMarker) {
+			source, encrypted = strings.TrimPrefix(source, encryptedMarker), true
+		} else {
+			break
+		}
+	}
+
+	if !strings.Contains(source, "{{") {
+		return source, encrypted, optional, nil
+	}
+	tmpl, err := template.New(entry).Option("missingkey=error").Parse(source)
+	if err != nil {
+		return "", false, false, fmt.Errorf("invalid values_files entry %s: %w", entry, err)
+	}
+	expanded := &strings.Builder{}
+	if err := tmpl.Execute(expanded, vf.metadata); err != nil {
+		return "", false, false, fmt.Errorf("invalid values_files entry %s: %w", entry, err)
+	}
+	return expanded.String(), encrypted, optional, nil
+}
+
+func (vf *valuesFiles) decrypt(source string) ([]byte, error) {
+	sops := command(sopsBin, "--decrypt", source)
+	sops.Stderr(vf.stderr)
+
+	if vf.debug {
+		fmt.Fprintf(vf.stderr, "Generated command: '%s'\n", sops.String())
+	}
+
+	plaintext, err := sops.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt values file %s: %w", source, err)
+	}
+	return plaintext, nil
+}
+
+func (vf *valuesFiles) writeTemp(source string, contents []byte) (string, error) {
+	// os.CreateTemp creates files with 0600 permissions, so the plaintext is only readable by the current user
+	file, err := os.CreateTemp("", "values********"+filepath.Ext(source))
+	if err != nil {
+		return "", fmt.Errorf("failed to create values file: %w", err)
+	}
+	defer file.Close()
+	vf.tempFiles = append(vf.tempFiles, file.Name())
+
+	if vf.debug {
+		fmt.Fprintf(vf.stderr, "writing %s to %s\n", source, file.Name())
+	}
+	if _, err := file.Write(contents); err != nil {
+		return "", fmt.Errorf("failed to write values file: %w", err)
+	}
+	return file.Name(), nil
+}
+
+func (vf *valuesFiles) flags() []string {
+	flags := make([]string, 0)
+	for _, filename := range vf.filenames {
+		flags = append(flags, "--values", filename)
+	}
+	return flags
+}
+
+func (vf *valuesFiles) cleanup() error {
+	for _, filename := range vf.tempFiles {
+		if vf.debug {
+			fmt.Fprintf(vf.stderr, "removing %s\n", filename)
+		}
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove values file: %w", err)
+		}
+	}
+	vf.tempFiles = nil
+	return nil
+}
@@ -0,0 +1,248 @@
+package run
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/yaml.v3"
+)
+
+type ValuesFilesTestSuite struct {
+	suite.Suite
+	ctrl            *gomock.Controller
+	mockCmd         *Mockcmd
+	originalCommand func(string, ...string) cmd
+}
+
+func (suite *ValuesFilesTestSuite) BeforeTest(_, _ string) {
+	suite.ctrl = gomock.NewController(suite.T())
+	suite.mockCmd = NewMockcmd(suite.ctrl)
+
+	suite.originalCommand = command
+	command = func(path string, args ...string) cmd { return suite.mockCmd }
+}
+
+func (suite *ValuesFilesTestSuite) AfterTest(_, _ string) {
+	command = suite.originalCommand
+}
+
+func TestValuesFilesTestSuite(t *testing.T) {
+	suite.Run(t, new(ValuesFilesTestSuite))
+}
+
+func (suite *ValuesFilesTestSuite) TestPlaintextFiles() {
+	vf := newValuesFiles(env.Config{ValuesFiles: []string{"./base.yml", "./prod.yml"}})
+	suite.Require().NoError(vf.write())
+	suite.Equal([]string{"--values", "./base.yml", "--values", "./prod.yml"}, vf.flags())
+	suite.Empty(vf.tempFiles)
+}
+
+func (suite *ValuesFilesTestSuite) TestDecryptsMarkedFiles() {
+	defer suite.ctrl.Finish()
+
+	vf := newValuesFiles(env.Config{ValuesFiles: []string{"./base.yml", "sops:./secrets.enc.yaml"}})
+
+	command = func(path string, args ...string) cmd {
+		suite.Equal(sopsBin, path)
+		suite.Equal([]string{"--decrypt", "./secrets.enc.yaml"}, args)
+		return suite.mockCmd
+	}
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+	suite.mockCmd.EXPECT().
+		Output().
+		Return([]byte("password: correct horse battery staple\n"), nil)
+
+	suite.Require().NoError(vf.write())
+	suite.Require().Len(vf.tempFiles, 1)
+	decrypted := vf.tempFiles[0]
+	suite.True(strings.HasSuffix(decrypted, ".yaml"), "the decrypted file should keep the source's extension")
+	suite.Equal([]string{"--values", "./base.yml", "--values", decrypted}, vf.flags())
+
+	contents, err := os.ReadFile(decrypted)
+	suite.Require().NoError(err)
+	suite.Equal("password: correct horse battery staple\n", string(contents))
+
+	info, err := os.Stat(decrypted)
+	suite.Require().NoError(err)
+	suite.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	suite.Require().NoError(vf.cleanup())
+	_, err = os.Stat(decrypted)
+	suite.True(os.IsNotExist(err), "cleanup should remove the decrypted file")
+}
+
+// TestDecryptsWithSops runs the real sops, with an age key made for the test, so it only runs where sops and age are
+// installed.
+func (suite *ValuesFilesTestSuite) TestDecryptsWithSops() {
+	sops, err := exec.LookPath("sops")
+	if err != nil {
+		suite.T().Skip("sops isn't installed")
+	}
+	ageKeygen, err := exec.LookPath("age-keygen")
+	if err != nil {
+		suite.T().Skip("age isn't installed")
+	}
+
+	dir := suite.T().TempDir()
+	keyFile := filepath.Join(dir, "key.txt")
+	suite.Require().NoError(exec.Command(ageKeygen, "-o", keyFile).Run())
+	key, err := os.ReadFile(keyFile)
+	suite.Require().NoError(err)
+	_, publicKey, found := strings.Cut(string(key), "# public key: ")
+	suite.Require().True(found, "age-keygen should write the public key as a comment")
+	publicKey, _, _ = strings.Cut(publicKey, "\n")
+
+	plaintext := filepath.Join(dir, "secrets.yaml")
+	suite.Require().NoError(os.WriteFile(plaintext, []byte("password: correct horse battery staple\n"), 0600))
+	encrypted, err := exec.Command(sops, "--encrypt", "--age", publicKey, plaintext).Output()
+	suite.Require().NoError(err)
+	suite.NotContains(string(encrypted), "correct horse battery staple")
+	encryptedFile := filepath.Join(dir, "secrets.enc.yaml")
+	suite.Require().NoError(os.WriteFile(encryptedFile, encrypted, 0600))
+
+	suite.T().Setenv("SOPS_AGE_KEY_FILE", keyFile)
+	command = func(path string, args ...string) cmd {
+		if path == sopsBin {
+			path = sops
+		}
+		return suite.originalCommand(path, args...)
+	}
+
+	vf := newValuesFiles(env.Config{ValuesFiles: []string{"sops:" + encryptedFile}, Stderr: &strings.Builder{}})
+	suite.Require().NoError(vf.write())
+	defer vf.cleanup()
+	suite.Require().Len(vf.tempFiles, 1)
+	contents, err := os.ReadFile(vf.tempFiles[0])
+	suite.Require().NoError(err)
+	suite.Equal("password: correct horse battery staple\n", string(contents))
+}
+
+func (suite *ValuesFilesTestSuite) TestDecryptionFailure() {
+	defer suite.ctrl.Finish()
+
+	vf := newValuesFiles(env.Config{ValuesFiles: []string{"sops:./secrets.enc.yaml"}})
+
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+	suite.mockCmd.EXPECT().
+		Output().
+		Return(nil, errors.New("no key could decrypt the data"))
+
+	err := vf.write()
+	suite.EqualError(err, "failed to decrypt values file ./secrets.enc.yaml: no key could decrypt the data")
+	suite.Empty(vf.tempFiles)
+}
+
+func (suite *ValuesFilesTestSuite) TestDebug() {
+	defer suite.ctrl.Finish()
+
+	stderr := strings.Builder{}
+	vf := newValuesFiles(env.Config{ValuesFiles: []string{"sops:./secrets.enc.yaml"}, Debug: true, Stderr: &stderr})
+
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+	suite.mockCmd.EXPECT().String().Return("sops --decrypt ./secrets.enc.yaml")
+	suite.mockCmd.EXPECT().Output().Return([]byte("{}"), nil)
+
+	suite.Require().NoError(vf.write())
+	defer vf.cleanup()
+
+	suite.Contains(stderr.String(), "Generated command: 'sops --decrypt ./secrets.enc.yaml'\n")
+	suite.Contains(stderr.String(), fmt.Sprintf("writing ./secrets.enc.yaml to %s\n", vf.tempFiles[0]))
+}
+
+func (suite *ValuesFilesTestSuite) TestResolvesReferences() {
+	suite.T().Setenv("DRONE_HELM3_TEST_PASSWORD", "hunter2")
+
+	valuesFile, err := tempfile("values********.yml", "password: ${env:DRONE_HELM3_TEST_PASSWORD}\nhome: $HOME\n")
+	suite.Require().NoError(err)
+	defer os.Remove(valuesFile.Name())
+
+	vf := newValuesFiles(env.Config{ValuesFiles: []string{valuesFile.Name()}})
+	suite.Require().NoError(vf.write())
+	defer vf.cleanup()
+
+	suite.Require().Len(vf.tempFiles, 1, "a file with references should be copied")
+	suite.Equal([]string{"--values", vf.tempFiles[0]}, vf.flags())
+
+	contents, err := os.ReadFile(vf.tempFiles[0])
+	suite.Require().NoError(err)
+	suite.Equal("password: hunter2\nhome: $HOME\n", string(contents), "bare $VARs should be left alone in values files")
+}
+
+func (suite *ValuesFilesTestSuite) TestReferencesCantChangeStructure() {
+	suite.T().Setenv("DRONE_HELM3_TEST_PASSWORD", "hunter2\nadmin: true")
+	suite.T().Setenv("DRONE_HELM3_TEST_REPLICAS", "3")
+
+	valuesFile, err := tempfile("values********.yml", "# credentials\n"+
+		"password: ${env:DRONE_HELM3_TEST_PASSWORD}\n"+
+		"replicas: ${env:DRONE_HELM3_TEST_REPLICAS}\n"+
+		"version: \"${env:DRONE_HELM3_TEST_REPLICAS}\"\n"+
+		"hosts:\n  - ${env:DRONE_HELM3_TEST_PASSWORD}\n")
+	suite.Require().NoError(err)
+	defer os.Remove(valuesFile.Name())
+
+	vf := newValuesFiles(env.Config{ValuesFiles: []string{valuesFile.Name()}})
+	suite.Require().NoError(vf.write())
+	defer vf.cleanup()
+	suite.Require().Len(vf.tempFiles, 1)
+
+	contents, err := os.ReadFile(vf.tempFiles[0])
+	suite.Require().NoError(err)
+	suite.Contains(string(contents), "# credentials\n", "comments should be kept")
+
+	var values map[string]interface{}
+	suite.Require().NoError(yaml.Unmarshal(contents, &values))
+	suite.Equal(map[string]interface{}{
+		"password": "hunter2\nadmin: true",
+		"replicas": 3,
+		"version":  "3",
+		"hosts":    []interface{}{"hunter2\nadmin: true"},
+	}, values)
+}
+
+func (suite *ValuesFilesTestSuite) TestResolveFailure() {
+	valuesFile, err := tempfile("values********.yml", "password: ${file:/usr/foreign/exclude/password}\n")
+	suite.Require().NoError(err)
+	defer os.Remove(valuesFile.Name())
+
+	vf := newValuesFiles(env.Config{ValuesFiles: []string{valuesFile.Name()}})
+	err = vf.write()
+	suite.Require().Error(err)
+	suite.Contains(err.Error(), fmt.Sprintf("in values file %s: could not resolve ${file:/usr/foreign/exclude/password}", valuesFile.Name()))
+}
+
+func (suite *ValuesFilesTestSuite) TestPlaceholders() {
+	vf := newValuesFiles(env.Config{
+		ValuesFiles: []string{"./values-{{ .DeployTo }}.yml", "./{{ .Branch }}/{{ .Event }}.yml"},
+		DeployTo:    "production",
+		Branch:      "main",
+		DroneEvent:  "promote",
+	})
+	suite.Require().NoError(vf.write())
+	suite.Equal([]string{"--values", "./values-production.yml", "--values", "./main/promote.yml"}, vf.flags())
+}
+
+func (suite *ValuesFilesTestSuite) TestInvalidPlaceholder() {
+	vf := newValuesFiles(env.Config{ValuesFiles: []string{"./values-{{ .Planet }}.yml"}})
+	suite.Regexp(`invalid values_files entry \./values-\{\{ \.Planet \}\}\.yml`, vf.write())
+}
+
+func (suite *ValuesFilesTestSuite) TestOptionalFiles() {
+	present, err := os.CreateTemp(suite.T().TempDir(), "values-*.yml")
+	suite.Require().NoError(err)
+	present.Close()
+
+	vf := newValuesFiles(env.Config{
+		ValuesFiles: []string{"optional:" + present.Name(), "optional:./values-{{ .DeployTo }}.yml", "./base.yml"},
+		DeployTo:    "staging",
+	})
+	suite.Require().NoError(vf.write())
+	suite.Equal([]string{"--values", present.Name(), "--values", "./base.yml"}, vf.flags())
+}